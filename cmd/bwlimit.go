@@ -0,0 +1,185 @@
+// Copyright © 2019 Bdoner
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/bdoner/net-copy/ncproto/ncclient"
+)
+
+// bwRule limits the bandwidth to rate between two times of the day
+type bwRule struct {
+	from, to time.Duration
+	rate     uint64
+}
+
+// bwSchedule is a parsed --bwlimit. The first rule matching the time of day
+// decides the rate, otherwise the default rate is used
+type bwSchedule struct {
+	rules []bwRule
+	rate  uint64
+}
+
+// parseBWLimit parses a bandwidth limit like 50M or a schedule like
+// 08:00-18:00=10M,22:00-06:00=0,50M where 0 means no limit
+func parseBWLimit(spec string) (bwSchedule, error) {
+	var s bwSchedule
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		eq := strings.Index(part, "=")
+		if eq == -1 {
+			rate, err := parseByteSize(part)
+			if err != nil {
+				return s, err
+			}
+
+			s.rate = rate
+			continue
+		}
+
+		times := strings.SplitN(part[:eq], "-", 2)
+		if len(times) != 2 {
+			return s, fmt.Errorf("invalid bandwidth rule %s. Use HH:MM-HH:MM=RATE", part)
+		}
+
+		from, err := parseTimeOfDay(times[0])
+		if err != nil {
+			return s, err
+		}
+
+		to, err := parseTimeOfDay(times[1])
+		if err != nil {
+			return s, err
+		}
+
+		rate, err := parseByteSize(part[eq+1:])
+		if err != nil {
+			return s, err
+		}
+
+		s.rules = append(s.rules, bwRule{from: from, to: to, rate: rate})
+	}
+
+	return s, nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %s. Use HH:MM", s)
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// rateAt returns the bytes per second allowed at t
+func (s *bwSchedule) rateAt(t time.Time) uint64 {
+	tod := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	for _, r := range s.rules {
+		// a rule like 22:00-06:00 wraps around midnight
+		if (r.from <= r.to && r.from <= tod && tod < r.to) || (r.to < r.from && (r.from <= tod || tod < r.to)) {
+			return r.rate
+		}
+	}
+
+	return s.rate
+}
+
+// newRateLimiter sets up the limiter shared by all transfers of this process.
+// It follows the --bwlimit schedule and rereads --bwlimit-file on SIGHUP.
+// nil is returned when no limit is configured
+func newRateLimiter() (*ncclient.RateLimiter, error) {
+	if conf.BWLimit == "" && conf.BWLimitFile == "" {
+		return nil, nil
+	}
+
+	schedule, err := parseBWLimit(conf.BWLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	if conf.BWLimitFile != "" {
+		schedule, err = readBWLimitFile(schedule)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	limiter := ncclient.NewRateLimiter(schedule.rateAt(time.Now()))
+	go controlBandwidth(limiter, schedule)
+	return limiter, nil
+}
+
+func readBWLimitFile(current bwSchedule) (bwSchedule, error) {
+	data, err := ioutil.ReadFile(conf.BWLimitFile)
+	if err != nil {
+		return current, err
+	}
+
+	return parseBWLimit(string(data))
+}
+
+func controlBandwidth(limiter *ncclient.RateLimiter, schedule bwSchedule) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hup:
+			if conf.BWLimitFile == "" {
+				continue
+			}
+
+			s, err := readBWLimitFile(schedule)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "controlBandwidth: keeping the current limit: %v\n", err)
+				continue
+			}
+			schedule = s
+
+		case <-ticker.C:
+		}
+
+		rate := schedule.rateAt(time.Now())
+		if rate != limiter.Rate() {
+			limiter.SetRate(rate)
+			if rate == 0 {
+				fmt.Fprintln(out, "bandwidth is no longer limited")
+			} else {
+				fmt.Fprintf(out, "bandwidth limited to %s/s\n", formatByteSize(int64(rate)))
+			}
+		}
+	}
+}
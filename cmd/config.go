@@ -0,0 +1,187 @@
+// Copyright © 2019 Bdoner
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix turns a flag like on-conflict into NETCOPY_ON_CONFLICT
+const envPrefix = "NETCOPY_"
+
+// configFile is the layout of the --config file. Both defaults and profiles map
+// long flag names to values, e.g.
+//
+//	defaults:
+//	  threads: 4
+//	profiles:
+//	  buildbox:
+//	    host: build.example.com
+//	    port: 3405
+//	    allow: [10.0.0.0/8]
+//
+// A profile takes precedence over the defaults
+type configFile struct {
+	Defaults map[string]interface{}            `yaml:"defaults"`
+	Profiles map[string]map[string]interface{} `yaml:"profiles"`
+}
+
+// profile is the name of the profile given by --profile
+var profile string
+
+// loadConfig sets every flag of cmd which was not given on the command line.
+// Environment variables take precedence over the config file
+func loadConfig(cmd *cobra.Command) error {
+	var err error
+	cmd.Flags().VisitAll(func(f *pflag.Flag) {
+		env := envPrefix + strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
+		v, found := os.LookupEnv(env)
+		if err != nil || f.Changed || !found {
+			return
+		}
+
+		if serr := cmd.Flags().Set(f.Name, v); serr != nil {
+			err = fmt.Errorf("invalid value %q for %s: %v", v, env, serr)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	values, err := readConfig()
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if !knownFlag(cmd.Root(), name) {
+			return fmt.Errorf("unknown flag %s in config file", name)
+		}
+
+		// a profile may be shared by commands with different flags
+		f := cmd.Flags().Lookup(name)
+		if f == nil || f.Changed {
+			continue
+		}
+
+		err = setFlag(cmd.Flags(), name, values[name])
+		if err != nil {
+			return fmt.Errorf("invalid value for %s in config file: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+// readConfig returns the defaults of the config file merged with the selected profile.
+// A missing config file is only an error if it or a profile was asked for
+func readConfig() (map[string]interface{}, error) {
+	path := cfgFile
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil
+		}
+		path = filepath.Join(home, ".config", "net-copy", "config.yaml")
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && cfgFile == "" && profile == "" {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("could not read config file: %v", err)
+	}
+
+	var c configFile
+	err = yaml.Unmarshal(data, &c)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse config file %s: %v", path, err)
+	}
+
+	values := make(map[string]interface{})
+	for k, v := range c.Defaults {
+		values[k] = v
+	}
+
+	if profile == "" {
+		return values, nil
+	}
+
+	p, found := c.Profiles[profile]
+	if !found {
+		return nil, fmt.Errorf("no profile %s in config file %s", profile, path)
+	}
+
+	for k, v := range p {
+		values[k] = v
+	}
+
+	return values, nil
+}
+
+// setFlag sets a flag to a config value. Every item of a list is added to the flag
+func setFlag(flags *pflag.FlagSet, name string, value interface{}) error {
+	items, ok := value.([]interface{})
+	if !ok {
+		return flags.Set(name, fmt.Sprint(value))
+	}
+
+	for _, i := range items {
+		err := flags.Set(name, fmt.Sprint(i))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// knownFlag reports whether any command has a flag called name
+func knownFlag(cmd *cobra.Command, name string) bool {
+	if cmd.Flags().Lookup(name) != nil || cmd.PersistentFlags().Lookup(name) != nil {
+		return true
+	}
+
+	for _, c := range cmd.Commands() {
+		if knownFlag(c, name) {
+			return true
+		}
+	}
+
+	return false
+}
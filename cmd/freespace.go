@@ -0,0 +1,7 @@
+package cmd
+
+import "errors"
+
+// errFreeSpaceUnknown is returned by freeSpace on platforms where
+// the free space of a filesystem can't be determined
+var errFreeSpaceUnknown = errors.New("free space unknown")
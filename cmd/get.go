@@ -0,0 +1,115 @@
+// Copyright © 2019 Bdoner
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/bdoner/net-copy/internal/ncprogress"
+	"github.com/bdoner/net-copy/ncproto"
+	"github.com/bdoner/net-copy/ncproto/ncclient"
+
+	"github.com/spf13/cobra"
+)
+
+// getCmd represents the get command
+var getCmd = &cobra.Command{
+	Use:   "get host:port/path...",
+	Short: "Fetch files from a serving net-copy",
+	Long: `
+	Connects to a net-copy started with serve (IPv6 addresses are given
+	in brackets, e.g. [::1]:3405/path) and fetches the given files
+	or directories into the working-directory (-d). Directories are fetched
+	recursively. All paths must point to the same host.`,
+	Args:   cobra.MinimumNArgs(1),
+	PreRun: setupOutputDir,
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		defer func() { events.Summary(err) }()
+
+		var host string
+		var port uint16
+		paths := make([]string, 0, len(args))
+		for _, a := range args {
+			h, p, path, err := parseRemote(a)
+			if err != nil {
+				return err
+			}
+
+			if len(paths) != 0 && (h != host || p != port) {
+				return fmt.Errorf("all paths must be fetched from the same host")
+			}
+
+			host, port = h, p
+			paths = append(paths, path)
+		}
+
+		// only the fetched subtrees are cleaned up, not all of the working directory
+		removeTempFiles(conf.WorkingDirectory, false)
+		for _, p := range paths {
+			if name := path.Base(path.Clean("/" + p)); name != "/" {
+				removeTempFiles(filepath.Join(conf.WorkingDirectory, name), true)
+			} else {
+				removeTempFiles(conf.WorkingDirectory, true)
+			}
+		}
+
+		cln, err := ncclient.Connect(host, port, conf.PreferIP)
+		if err != nil {
+			return err
+		}
+
+		defer cln.Close()
+
+		events.SessionStart(conf.ConnectionID, "get", cln.Connection.RemoteAddr())
+
+		if !conf.Quiet {
+			progress = ncprogress.New(out)
+		}
+
+		cln.SendMessage(ncproto.GetRequest{
+			ConnectionID: conf.ConnectionID,
+			Paths:        paths,
+		})
+
+		s, err := loop(cln, nil)
+		if err != nil {
+			return err
+		}
+
+		reportSummary(s)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(getCmd)
+
+	getCmd.Flags().StringVar(&conf.PreferIP, "prefer-ip", "", "try IPv4 (4) or IPv6 (6) addresses first when a host resolves to both")
+	getCmd.Flags().StringVarP(&conf.WorkingDirectory, "working-dir", "d", ".", "set the directory to output files to")
+	getCmd.Flags().BoolVarP(&conf.Quiet, "quiet", "q", false, "don't print each received file")
+	getCmd.Flags().StringVar(&conf.Output, "output", "text", "text, or json to print newline delimited events for scripts instead")
+	getCmd.Flags().StringVar(&conf.SummaryFile, "summary-file", "", "also write the end-of-transfer summary to this file")
+	getCmd.Flags().StringVar(&conf.OnConflict, "on-conflict", conflictFail, fmt.Sprintf("what to do when a fetched file already exists. One of %s", strings.Join(conflictPolicies, ", ")))
+	addWriteFlags(getCmd)
+}
@@ -0,0 +1,103 @@
+// Copyright © 2019 Bdoner
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/google/uuid"
+
+	"github.com/bdoner/net-copy/ncproto"
+)
+
+// limits keeps track of the resources a receive session uses and
+// enforces the --max-* flags. A limit of 0 is not enforced
+type limits struct {
+	files     uint64
+	announced uint64
+	received  uint64
+	perFile   map[uuid.UUID]uint64
+}
+
+func newLimits() *limits {
+	return &limits{perFile: make(map[uuid.UUID]uint64)}
+}
+
+// announce checks a newly announced file while open files are being received
+func (l *limits) announce(f *ncproto.File, open int) error {
+	rel := f.RelativeFilePath(&conf)
+	if f.FileSize < 0 {
+		return fmt.Errorf("%s has a negative size", rel)
+	}
+
+	l.files++
+	if 0 < conf.MaxFiles && conf.MaxFiles < l.files {
+		return fmt.Errorf("file limit of %d files exceeded", conf.MaxFiles)
+	}
+
+	if 0 < conf.MaxFileSize && conf.MaxFileSize < uint64(f.FileSize) {
+		return fmt.Errorf("%s (%s) exceeds the file size limit of %s", rel, formatByteSize(f.FileSize), formatByteSize(int64(conf.MaxFileSize)))
+	}
+
+	l.announced += uint64(f.FileSize)
+	if 0 < conf.MaxBytes && conf.MaxBytes < l.announced {
+		return fmt.Errorf("transfer exceeds the limit of %s", formatByteSize(int64(conf.MaxBytes)))
+	}
+
+	depth := 0
+	for _, c := range f.RelativePath {
+		if c != "." {
+			depth++
+		}
+	}
+
+	if 0 < conf.MaxDepth && int(conf.MaxDepth) < depth {
+		return fmt.Errorf("%s exceeds the path depth limit of %d", rel, conf.MaxDepth)
+	}
+
+	if 0 < conf.MaxOpenFiles && int(conf.MaxOpenFiles) <= open {
+		return fmt.Errorf("limit of %d files transferred at once exceeded", conf.MaxOpenFiles)
+	}
+
+	l.perFile[f.ID] = 0
+	return nil
+}
+
+// receive checks the actual bytes received against what was announced
+func (l *limits) receive(f *ncproto.File, chunk *ncproto.FileChunk) error {
+	n := uint64(len(chunk.Data))
+	l.perFile[f.ID] += n
+	if uint64(f.FileSize) < l.perFile[f.ID] {
+		return fmt.Errorf("received more data for %s than the announced %s", f.RelativeFilePath(&conf), f.PrettySize())
+	}
+
+	l.received += n
+	if 0 < conf.MaxBytes && conf.MaxBytes < l.received {
+		return fmt.Errorf("transfer exceeds the limit of %s", formatByteSize(int64(conf.MaxBytes)))
+	}
+
+	return nil
+}
+
+// complete forgets about a file that has been fully received
+func (l *limits) complete(id uuid.UUID) {
+	delete(l.perFile, id)
+}
@@ -0,0 +1,91 @@
+// Copyright © 2019 Bdoner
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"text/tabwriter"
+
+	"github.com/bdoner/net-copy/ncproto"
+	"github.com/bdoner/net-copy/ncproto/ncclient"
+
+	"github.com/spf13/cobra"
+)
+
+// lsCmd represents the ls command
+var lsCmd = &cobra.Command{
+	Use:   "ls host:port/path",
+	Short: "List files on a serving net-copy",
+	Long: `
+	Connects to a net-copy started with serve (IPv6 addresses are given
+	in brackets, e.g. [::1]:3405/path) and lists the name, size and
+	modification time of every entry found at the given path.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		host, port, path, err := parseRemote(args[0])
+		if err != nil {
+			return err
+		}
+
+		cln, err := ncclient.Connect(host, port, conf.PreferIP)
+		if err != nil {
+			return err
+		}
+
+		defer cln.Close()
+
+		cln.SendMessage(ncproto.ListRequest{Path: path})
+
+		var message ncproto.INetCopyMessage
+		err = cln.GetNextMessage(&message)
+		if err != nil {
+			return err
+		}
+
+		switch message.(type) {
+		case ncproto.Listing:
+			printListing(message.(ncproto.Listing))
+			return nil
+		case ncproto.SessionError:
+			return fmt.Errorf("%s", message.(ncproto.SessionError).Message)
+		default:
+			return fmt.Errorf("unexpected answer %T to list request", message)
+		}
+	},
+}
+
+func printListing(listing ncproto.Listing) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', tabwriter.AlignRight)
+	for _, e := range listing.Entries {
+		name := e.Name
+		if e.IsDir {
+			name += "/"
+		}
+		fmt.Fprintf(w, "%s\t%s\t %s\n", ncproto.PrettySize(e.Size), e.ModTime.Format("2006-01-02 15:04"), name)
+	}
+	w.Flush()
+}
+
+func init() {
+	rootCmd.AddCommand(lsCmd)
+
+	lsCmd.Flags().StringVar(&conf.PreferIP, "prefer-ip", "", "try IPv4 (4) or IPv6 (6) addresses first when a host resolves to both")
+}
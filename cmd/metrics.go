@@ -0,0 +1,167 @@
+// Copyright © 2019 Bdoner
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// receiveMetrics are the Prometheus metrics gathered by loop and its
+// writer goroutines. All methods may be called on a nil receiveMetrics
+type receiveMetrics struct {
+	mu             sync.Mutex
+	bytes          prometheus.Counter
+	filesCompleted prometheus.Counter
+	filesFailed    prometheus.Counter
+	sessions       prometheus.Gauge
+	chunkWrite     prometheus.Histogram
+	throughput     *prometheus.GaugeVec
+	started        map[uuid.UUID]time.Time
+	received       map[uuid.UUID]float64
+}
+
+// metrics is nil unless --metrics-addr is used
+var metrics *receiveMetrics
+
+// serveMetrics registers the receive metrics and serves them on addr/metrics.
+// The address is bound right away so a bad --metrics-addr fails early
+func serveMetrics(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	m := &receiveMetrics{
+		bytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "netcopy_received_bytes_total",
+			Help: "Bytes written to received files.",
+		}),
+		filesCompleted: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "netcopy_files_completed_total",
+			Help: "Files completely received and moved into place.",
+		}),
+		filesFailed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "netcopy_files_failed_total",
+			Help: "Files that were rejected or could not be written.",
+		}),
+		sessions: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "netcopy_active_sessions",
+			Help: "Sessions currently receiving files.",
+		}),
+		chunkWrite: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "netcopy_chunk_write_duration_seconds",
+			Help:    "Time spent writing a single chunk to disk.",
+			Buckets: prometheus.ExponentialBuckets(0.00001, 4, 10),
+		}),
+		throughput: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "netcopy_session_throughput_bytes_per_second",
+			Help: "Average rate files are written at since the session started.",
+		}, []string{"session"}),
+		started:  make(map[uuid.UUID]time.Time),
+		received: make(map[uuid.UUID]float64),
+	}
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(m.bytes, m.filesCompleted, m.filesFailed, m.sessions, m.chunkWrite, m.throughput)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	go func() {
+		err := http.Serve(l, mux)
+		fmt.Fprintf(os.Stderr, "serveMetrics: %v\n", err)
+	}()
+
+	metrics = m
+	return nil
+}
+
+func (m *receiveMetrics) sessionStarted(id uuid.UUID) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.started[id] = time.Now()
+	m.sessions.Inc()
+}
+
+// sessionDone keeps the final throughput of the session but stops updating it
+func (m *receiveMetrics) sessionDone(id uuid.UUID) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.started, id)
+	delete(m.received, id)
+	m.sessions.Dec()
+}
+
+func (m *receiveMetrics) chunkWritten(id uuid.UUID, n int, d time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.bytes.Add(float64(n))
+	m.chunkWrite.Observe(d.Seconds())
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	started, found := m.started[id]
+	if !found {
+		return
+	}
+
+	m.received[id] += float64(n)
+	if elapsed := time.Since(started).Seconds(); 0 < elapsed {
+		m.throughput.WithLabelValues(id.String()).Set(m.received[id] / elapsed)
+	}
+}
+
+func (m *receiveMetrics) fileCompleted() {
+	if m == nil {
+		return
+	}
+
+	m.filesCompleted.Inc()
+}
+
+func (m *receiveMetrics) fileFailed() {
+	if m == nil {
+		return
+	}
+
+	m.filesFailed.Inc()
+}
@@ -0,0 +1,17 @@
+//go:build linux
+// +build linux
+
+package cmd
+
+import (
+	"os"
+	"syscall"
+)
+
+// fallocKeepSize reserves the blocks without changing the size of the file
+const fallocKeepSize = 0x01
+
+// preallocate reserves size bytes of disk space for f
+func preallocate(f *os.File, size int64) error {
+	return syscall.Fallocate(int(f.Fd()), fallocKeepSize, 0, size)
+}
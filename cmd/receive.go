@@ -21,14 +21,21 @@
 package cmd
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 
+	"github.com/bdoner/net-copy/internal/ncevent"
+	"github.com/bdoner/net-copy/internal/ncprogress"
 	"github.com/bdoner/net-copy/ncproto"
 	"github.com/bdoner/net-copy/ncproto/ncclient"
 
@@ -37,7 +44,11 @@ import (
 
 var (
 	rconf      ncproto.Config
-	knownFiles map[uuid.UUID]ncproto.File
+	knownFiles map[uuid.UUID]*ncproto.File
+	// progress is nil unless a command sets it up
+	progress *ncprogress.Tracker
+	// events is nil unless --output json is used
+	events *ncevent.Emitter
 )
 
 // receiveCmd represents the receive command
@@ -47,72 +58,134 @@ var receiveCmd = &cobra.Command{
 	Long: `
 	Receive opens a port (optionally given by -p) and starts listening for
 	an incoming connection. Once the connection is established net-copy
-	receives all the files defined by the sender and closes the connection.`,
+	receives all the files defined by the sender and closes the connection.
+
+	Files that already exist in the working-directory are handled according to
+	--on-conflict: overwrite them, skip the received file, rename the received
+	file with a numeric suffix, keep whichever is newer, or fail the transfer.
+
+	With --delete the working-directory is turned into an exact copy of the
+	senders directory by removing everything not present on the sender.`,
 	PreRun: func(cmd *cobra.Command, args []string) {
-		setupWorkingDir(cmd, args)
+		setupOutputDir(cmd, args)
+		removeTempFiles(conf.WorkingDirectory, true)
+	},
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		defer func() { events.Summary(err) }()
 
-		_, err := os.Open(conf.WorkingDirectory)
-		if err != nil {
-			if os.IsNotExist(err) {
-				fmt.Printf("Output directory does not exists. creating %s\n", conf.WorkingDirectory)
-				err := os.MkdirAll(conf.WorkingDirectory, 0775)
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "PreRun: could not create output directory: %v\n", err)
-					os.Exit(-1)
-				}
-			} else {
-				fmt.Fprintf(os.Stderr, "PreRun: could not open output directory: %v\n", err)
-				os.Exit(-1)
+		if conf.MetricsAddr != "" {
+			err = serveMetrics(conf.MetricsAddr)
+			if err != nil {
+				return err
 			}
 		}
 
-		wdFiles, err := ioutil.ReadDir(conf.WorkingDirectory)
+		srv, err := ncclient.Listen(&conf, readyFunc())
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "PreRun: could not open output directory: %v\n", err)
-			os.Exit(-1)
+			return err
 		}
 
-		if 0 < len(wdFiles) {
-			fmt.Fprintf(os.Stderr, "PreRun: can only output into an empty directory\n%s is not empty\n", conf.WorkingDirectory)
-			os.Exit(-1)
-		}
-	},
-	RunE: func(cmd *cobra.Command, args []string) error {
-		srv, err := ncclient.Listen(conf.Port)
+		defer srv.Close()
+
+		err = receiveSession(srv, ncproto.ModeSend)
 		if err != nil {
 			return err
 		}
 
-		defer srv.Connection.Close()
+		events.SessionStart(conf.ConnectionID, "receive", srv.Connection.RemoteAddr())
+
+		m, err := receiveManifest(srv)
+		if err != nil {
+			return err
+		}
 
-		var cConf ncproto.INetCopyMessage
-		err = srv.GetNextMessage(&cConf)
+		err = preflight(m.Summary)
 		if err != nil {
+			srv.SendMessage(ncproto.SessionError{ConnectionID: conf.ConnectionID, Message: err.Error()})
 			return err
 		}
 
-		var c ncproto.Config
-		var ok bool
-		if c, ok = cConf.(ncproto.Config); !ok {
-			return fmt.Errorf("initial message was not of type config")
+		if !conf.Quiet {
+			progress = ncprogress.New(out)
+			progress.SetTotal(m.Summary.FileCount, m.Summary.TotalBytes)
+		}
+
+		if conf.Delete {
+			err = deleteExtraneous(m)
+			if err != nil {
+				srv.SendMessage(ncproto.SessionError{ConnectionID: conf.ConnectionID, Message: err.Error()})
+				return err
+			}
 		}
 
-		conf.Merge(c)
-		fmt.Printf("Accepted connection from %s\n", srv.Connection.RemoteAddr().String())
-		return loop(srv)
+		s, err := loop(srv, nil)
+		if err != nil {
+			return err
+		}
+
+		// the sender waits for the summary before it disconnects
+		srv.SendMessage(s)
+		reportSummary(s)
+		return nil
 	},
 }
 
-func loop(srv *ncclient.Client) error {
-	knownFiles = make(map[uuid.UUID]ncproto.File)
+// receiveSession reads the Session started by a connecting peer. A session
+// that is invalid or of another mode is refused with a SessionError
+func receiveSession(srv *ncclient.Client, mode string) error {
+	var message ncproto.INetCopyMessage
+	err := srv.GetNextMessage(&message)
+	if err != nil {
+		return err
+	}
+
+	s, ok := message.(ncproto.Session)
+	if !ok {
+		return fmt.Errorf("expected a session but got %T", message)
+	}
+
+	err = s.Validate(mode)
+	if err != nil {
+		srv.SendMessage(ncproto.SessionError{ConnectionID: s.ConnectionID, Message: err.Error()})
+		return err
+	}
+
+	conf.ConnectionID = s.ConnectionID
+	fmt.Fprintf(out, "Accepted connection from %s\n", srv.Connection.RemoteAddr().String())
+	return nil
+}
+
+// loop receives files until the peer closes the session and returns
+// a summary of the transfer once every file is written. Unless allowed
+// is nil only files with a slash separated path in allowed are accepted
+func loop(srv *ncclient.Client, allowed map[string]bool) (ncproto.TransferSummary, error) {
+	knownFiles = make(map[uuid.UUID]*ncproto.File)
+	// files written during this session are never in conflict with themselves
+	written := make(map[string]bool)
+	quota := newLimits()
+	report := newTransferReport()
 	var fwg sync.WaitGroup
 
+	// without credits the chunks of a file waiting for a writer would block loop
+	size := int(conf.Writers)
+	if !srv.Has(ncproto.CapCredits) {
+		size = 0
+	}
+	writers := newWriterPool(size)
+	defer writers.close()
+
+	progress.Run()
+	defer progress.Stop()
+
+	metrics.sessionStarted(conf.ConnectionID)
+	defer metrics.sessionDone(conf.ConnectionID)
+
 outer:
 	for {
 		var message ncproto.INetCopyMessage
 		err := srv.GetNextMessage(&message)
 		if err != nil {
-			return err
+			return ncproto.TransferSummary{}, err
 		}
 
 		switch message.(type) {
@@ -125,10 +198,28 @@ outer:
 			}
 			file, found := knownFiles[chunk.ID]
 			if !found {
-				return fmt.Errorf("unknown file for chunk %v", chunk)
+				return ncproto.TransferSummary{}, fmt.Errorf("unknown file for chunk %v", chunk)
 			}
 
-			file.ChunkQueue <- chunk
+			err = quota.receive(file, &chunk)
+			if err != nil {
+				srv.SendMessage(ncproto.SessionError{ConnectionID: conf.ConnectionID, Message: err.Error()})
+				return ncproto.TransferSummary{}, err
+			}
+
+			if !srv.Has(ncproto.CapCredits) {
+				file.ChunkQueue <- chunk
+				continue
+			}
+
+			// a peer keeping to its credits always finds room in the queue
+			select {
+			case file.ChunkQueue <- chunk:
+			default:
+				err = fmt.Errorf("peer sent more chunks of %s than granted", file.RelativeFilePath(&conf))
+				srv.SendMessage(ncproto.SessionError{ConnectionID: conf.ConnectionID, Message: err.Error()})
+				return ncproto.TransferSummary{}, err
+			}
 
 		case ncproto.File:
 			file := message.(ncproto.File)
@@ -138,45 +229,59 @@ outer:
 				continue
 			}
 
-			if !conf.Quiet {
-				fmt.Printf("%s (%s)\n", filepath.Join(filepath.Join(file.RelativePath...), file.Name), file.PrettySize())
-			}
-
-			err = os.MkdirAll(filepath.Dir(file.FullFilePath(&conf)), 0775)
+			err = quota.announce(&file, len(knownFiles))
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "loop: %v\n", err)
+				srv.SendMessage(ncproto.SessionError{ConnectionID: conf.ConnectionID, Message: err.Error()})
+				return ncproto.TransferSummary{}, err
 			}
 
-			fd, err := os.OpenFile(file.FullFilePath(&conf), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0775)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "loop: %v\n", err)
+			var write bool
+			err = checkFilePath(&file)
+			if err == nil && allowed != nil && !allowed[filepath.ToSlash(file.RelativeFilePath(&conf))] {
+				err = fmt.Errorf("the file was not agreed on")
 			}
 
-			file.FileDescriptor = fd
-			file.ChunkQueue = make(chan ncproto.FileChunk)
-			knownFiles[file.ID] = file
-
-			fwg.Add(1)
+			if err != nil {
+				rel := strings.Join(append(file.RelativePath[:len(file.RelativePath):len(file.RelativePath)], file.Name), "/")
+				fmt.Fprintf(os.Stderr, "loop: rejecting file %q from %s: %v\n", rel, srv.Connection.RemoteAddr().String(), err)
+				events.Error(rel, err)
+				metrics.fileFailed()
+				report.failed(rel, file.FileSize, err)
+			} else {
+				var reason string
+				write, reason, err = resolveConflict(&file, written)
+				if err != nil {
+					srv.SendMessage(ncproto.SessionError{ConnectionID: conf.ConnectionID, Message: err.Error()})
+					return ncproto.TransferSummary{}, err
+				}
 
-			go func(iFile *ncproto.File, ifwg *sync.WaitGroup) {
+				if !write {
+					report.skipped(filepath.ToSlash(file.RelativeFilePath(&conf)), file.FileSize, reason)
+				}
+			}
 
-				defer ifwg.Done()
-				defer iFile.FileDescriptor.Close()
+			if !conf.Quiet && write {
+				printf("%s (%s)\n", filepath.Join(filepath.Join(file.RelativePath...), file.Name), file.PrettySize())
+			}
 
-				for chunk := range iFile.ChunkQueue {
+			// written files are opened by the writer pool
+			if write {
+				written[file.FullFilePath(&conf)] = true
+				progress.FileStarted(&file, &conf)
+				events.FileStart(filepath.ToSlash(file.RelativeFilePath(&conf)), file.FileSize)
+			} else {
+				file.FileDescriptor = discardFile{}
+			}
 
-					n, err := iFile.FileDescriptor.Write(chunk.Data)
-					if err != nil {
-						fmt.Fprintf(os.Stderr, "loop: error writing chunk %d to file %s: %v\n", chunk.Seq, iFile.RelativeFilePath(&conf), err)
-						return
-					}
+			file.ChunkQueue = make(chan ncproto.FileChunk, ncproto.CreditWindow)
+			knownFiles[file.ID] = &file
 
-					if n != len(chunk.Data) {
-						fmt.Fprintf(os.Stderr, "loop: expected to write %d bytes but wrote %d bytes\n", len(chunk.Data), n)
-						return
-					}
-				}
-			}(&file, &fwg)
+			fwg.Add(1)
+			iFile := &file
+			writers.submit(func() {
+				defer fwg.Done()
+				writeFile(srv, iFile, report)
+			})
 
 		// lastPercentage := 0
 		// var receivedChunk ncproto.FileChunk
@@ -197,8 +302,47 @@ outer:
 				continue
 			}
 
-			file := knownFiles[completeMsg.ID]
+			file, found := knownFiles[completeMsg.ID]
+			if !found {
+				return ncproto.TransferSummary{}, fmt.Errorf("unknown file for complete message %v", completeMsg)
+			}
+
+			file.Checksum = completeMsg.Checksum
 			close(file.ChunkQueue)
+			delete(knownFiles, completeMsg.ID)
+			quota.complete(completeMsg.ID)
+
+		case ncproto.FileDelete:
+			fd := message.(ncproto.FileDelete)
+
+			if fd.ConnectionID != conf.ConnectionID {
+				fmt.Fprintf(os.Stderr, "loop: got delete message from %s but expected it from %s\n", fd.ConnectionID.String(), conf.ConnectionID.String())
+				continue
+			}
+
+			// deletes replicated by --watch are only carried out with --delete
+			p := filepath.Join(conf.WorkingDirectory, filepath.FromSlash(fd.Path))
+			err = ncproto.ValidatePath(fd.Path)
+			if err == nil && !conf.Delete {
+				err = fmt.Errorf("deleting is not enabled, use --delete to allow it")
+			}
+			if err == nil {
+				err = checkSymlinks(p)
+			}
+
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "loop: rejecting delete of %q from %s: %v\n", fd.Path, srv.Connection.RemoteAddr().String(), err)
+				continue
+			}
+
+			if !conf.Quiet {
+				printf("deleting %s\n", fd.Path)
+			}
+
+			err = os.RemoveAll(p)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "loop: %v\n", err)
+			}
 
 		case ncproto.ConnectionClose:
 			cc := message.(ncproto.ConnectionClose)
@@ -207,27 +351,446 @@ outer:
 				fmt.Fprintf(os.Stderr, "loop: got close message from %s but expected it from %s\n", cc.ConnectionID.String(), conf.ConnectionID.String())
 				continue
 			}
-			fmt.Println("client says done. closing connection.")
+			printf("client says done. closing connection.\n")
 			//srv.Connection.Close()
 			break outer
 			//os.Exit(0)
 
-		case ncproto.Config:
-			fmt.Fprintf(os.Stderr, "loop: initial MsgConfig already received.\n")
+		case ncproto.Session:
+			fmt.Fprintf(os.Stderr, "loop: session already started.\n")
 			continue
+
+		case ncproto.SessionError:
+			se := message.(ncproto.SessionError)
+			return ncproto.TransferSummary{}, fmt.Errorf("peer aborted the session: %s", se.Message)
 		}
 	}
 
-	fmt.Println("waiting for all files to be written")
+	printf("waiting for all files to be written\n")
 	fwg.Wait()
+	return report.finish(), nil
+}
+
+func receiveManifest(cln *ncclient.Client) (ncproto.Manifest, error) {
+	var message ncproto.INetCopyMessage
+	err := cln.GetNextMessage(&message)
+	if err != nil {
+		return ncproto.Manifest{}, err
+	}
+
+	switch message.(type) {
+	case ncproto.Manifest:
+		m := message.(ncproto.Manifest)
+		if m.ConnectionID != conf.ConnectionID {
+			return m, fmt.Errorf("got manifest from %s but expected it from %s", m.ConnectionID.String(), conf.ConnectionID.String())
+		}
+		return m, nil
+	case ncproto.SessionError:
+		return ncproto.Manifest{}, fmt.Errorf("peer aborted the session: %s", message.(ncproto.SessionError).Message)
+	default:
+		return ncproto.Manifest{}, fmt.Errorf("expected a manifest but got %T", message)
+	}
+}
+
+// preflight refuses a transfer that is known to exceed the limits
+// or the free space of the working directory before any data is sent
+func preflight(s ncproto.ManifestSummary) error {
+	fmt.Fprintf(out, "sender announced %d files (%s). the largest is %s (%s)\n", s.FileCount, ncproto.PrettySize(s.TotalBytes), s.LargestPath, ncproto.PrettySize(s.LargestSize))
+
+	if 0 < conf.MaxFiles && conf.MaxFiles < uint64(s.FileCount) {
+		return fmt.Errorf("%d files exceed the file limit of %d files", s.FileCount, conf.MaxFiles)
+	}
+
+	if 0 < conf.MaxFileSize && conf.MaxFileSize < uint64(s.LargestSize) {
+		return fmt.Errorf("%s (%s) exceeds the file size limit of %s", s.LargestPath, formatByteSize(s.LargestSize), formatByteSize(int64(conf.MaxFileSize)))
+	}
+
+	if 0 < conf.MaxBytes && conf.MaxBytes < uint64(s.TotalBytes) {
+		return fmt.Errorf("%s exceed the limit of %s", formatByteSize(s.TotalBytes), formatByteSize(int64(conf.MaxBytes)))
+	}
+
+	free, err := freeSpace(conf.WorkingDirectory)
+	if err == errFreeSpaceUnknown {
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("could not determine free space of %s: %v", conf.WorkingDirectory, err)
+	}
+
+	if free < uint64(s.TotalBytes) {
+		return fmt.Errorf("not enough free space in %s. %s needed but only %s available", conf.WorkingDirectory, ncproto.PrettySize(s.TotalBytes), ncproto.PrettySize(int64(free)))
+	}
+
+	return nil
+}
+
+// deleteExtraneous removes every file and directory in the working directory
+// that is not part of the senders manifest. Nothing is removed when more than
+// MaxDelete percent of the existing entries would go or when doing a dry run
+func deleteExtraneous(m ncproto.Manifest) error {
+	files := make(map[string]bool, len(m.Entries))
+	dirs := make(map[string]bool)
+	for _, e := range m.Entries {
+		files[e.Path] = true
+		for d := path.Dir(e.Path); d != "."; d = path.Dir(d) {
+			dirs[d] = true
+		}
+	}
+
+	existing, removed := 0, 0
+	extraneous := make([]string, 0)
+	removedDir := ""
+	err := filepath.Walk(conf.WorkingDirectory, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if p == conf.WorkingDirectory {
+			return nil
+		}
+
+		existing++
+		// entries below an extraneous directory go with it
+		if removedDir != "" && strings.HasPrefix(p, removedDir) {
+			removed++
+			return nil
+		}
+
+		rel, err := filepath.Rel(conf.WorkingDirectory, p)
+		if err != nil {
+			return err
+		}
+
+		rel = filepath.ToSlash(rel)
+		if fi.IsDir() && !dirs[rel] {
+			extraneous = append(extraneous, p)
+			removedDir = p + string(filepath.Separator)
+			removed++
+		} else if !fi.IsDir() && !files[rel] {
+			extraneous = append(extraneous, p)
+			removed++
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("could not scan %s for extraneous files: %v", conf.WorkingDirectory, err)
+	}
+
+	// a dry run never goes on with the transfer, even with nothing to delete
+	if conf.DryRun {
+		for _, p := range extraneous {
+			fmt.Fprintf(out, "would delete %s\n", p)
+		}
+		return fmt.Errorf("dry run: would delete %d of %d entries", removed, existing)
+	}
+
+	if len(extraneous) == 0 {
+		return nil
+	}
+
+	percentage := float64(removed) / float64(existing) * 100.0
+	if float64(conf.MaxDelete) < percentage {
+		return fmt.Errorf("refusing to delete %d of %d entries (%.0f%%), the limit is %d%%", removed, existing, percentage, conf.MaxDelete)
+	}
+
+	for _, p := range extraneous {
+		if !conf.Quiet {
+			fmt.Fprintf(out, "deleting %s\n", p)
+		}
+
+		err := os.RemoveAll(p)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "deleteExtraneous: %v\n", err)
+		}
+	}
+
 	return nil
 }
 
+// checkFilePath makes sure a file announced by the peer ends up
+// inside the working directory
+func checkFilePath(file *ncproto.File) error {
+	err := file.Validate()
+	if err != nil {
+		return err
+	}
+
+	return checkSymlinks(file.FullFilePath(&conf))
+}
+
+// checkSymlinks follows the symlinks of the existing parent directories of p
+// and makes sure they don't lead outside of the working directory
+func checkSymlinks(p string) error {
+	root, err := filepath.EvalSymlinks(conf.WorkingDirectory)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(p)
+	resolved, err := filepath.EvalSymlinks(dir)
+	for os.IsNotExist(err) {
+		dir = filepath.Dir(dir)
+		resolved, err = filepath.EvalSymlinks(dir)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if !isInside(root, resolved) {
+		return fmt.Errorf("%s escapes the working directory through a symlink", dir)
+	}
+
+	return nil
+}
+
+// isInside reports whether p is root or below it
+func isInside(root, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Policies for files that already exist in the working directory
+const (
+	conflictOverwrite = "overwrite"
+	conflictSkip      = "skip"
+	conflictRename    = "rename"
+	conflictNewer     = "newer"
+	conflictFail      = "fail"
+)
+
+var conflictPolicies = []string{conflictOverwrite, conflictSkip, conflictRename, conflictNewer, conflictFail}
+
+// discardFile swallows the chunks of a file that is not written to disk
+type discardFile struct{}
+
+func (discardFile) Write(p []byte) (int, error) { return len(p), nil }
+func (discardFile) Close() error                { return nil }
+
+// resolveConflict applies the --on-conflict policy to a file about to be received.
+// It reports whether the file should be written, or why it is skipped.
+// A renamed file gets a new Name
+func resolveConflict(file *ncproto.File, written map[string]bool) (bool, string, error) {
+	p := file.FullFilePath(&conf)
+	if written[p] {
+		return true, "", nil
+	}
+
+	fi, err := os.Stat(p)
+	if os.IsNotExist(err) {
+		return true, "", nil
+	}
+
+	if err != nil {
+		return false, "", err
+	}
+
+	rel := file.RelativeFilePath(&conf)
+	switch conf.OnConflict {
+	case conflictOverwrite:
+		return true, "", nil
+
+	case conflictSkip:
+		if !conf.Quiet {
+			printf("%s already exists, skipping\n", rel)
+		}
+		return false, "already exists", nil
+
+	case conflictNewer:
+		if file.ModTime.After(fi.ModTime()) {
+			return true, "", nil
+		}
+		if !conf.Quiet {
+			printf("%s is newer or as new on disk, skipping\n", rel)
+		}
+		return false, "newer or as new on disk", nil
+
+	case conflictRename:
+		ext := filepath.Ext(file.Name)
+		base := strings.TrimSuffix(file.Name, ext)
+		if base == "" {
+			base, ext = file.Name, ""
+		}
+
+		for i := 1; ; i++ {
+			name := fmt.Sprintf("%s-%d%s", base, i, ext)
+			np := filepath.Join(filepath.Dir(p), name)
+			if _, err := os.Stat(np); os.IsNotExist(err) && !written[np] {
+				if !conf.Quiet {
+					printf("%s already exists, renaming to %s\n", rel, name)
+				}
+				file.Name = name
+				return true, "", nil
+			}
+		}
+
+	default:
+		return false, "", fmt.Errorf("%s already exists", rel)
+	}
+}
+
+// writeFile creates a file announced by the peer, writes its chunks and
+// moves it into place once complete. Skipped files are only drained
+func writeFile(srv *ncclient.Client, f *ncproto.File, report *transferReport) {
+	defer progress.FileDone(f.ID)
+
+	started := time.Now()
+	_, skipped := f.FileDescriptor.(discardFile)
+	var cerr error
+	if !skipped {
+		f.FileDescriptor, cerr = createFile(f)
+	}
+
+	sum := sha256.New()
+	n, err := writeChunks(srv, f, sum, report)
+	if skipped {
+		return
+	}
+
+	if cerr != nil {
+		err = cerr
+	}
+
+	rel := filepath.ToSlash(f.RelativeFilePath(&conf))
+	// the checksum is set by loop before the queue is closed
+	if err == nil && len(f.Checksum) != 0 && !bytes.Equal(f.Checksum, sum.Sum(nil)) {
+		err = fmt.Errorf("checksum of %s does not match the sender's", rel)
+	}
+
+	err = commitFile(f, n, err)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "writeFile: %v\n", err)
+		events.Error(rel, err)
+		metrics.fileFailed()
+		report.failed(rel, f.FileSize, err)
+		return
+	}
+
+	events.FileDone(rel, n, started, sum.Sum(nil))
+	metrics.fileCompleted()
+	report.completed(rel, n, time.Since(started))
+}
+
+// createFile opens the temporary file f is written to. With --preallocate
+// the disk space for all of f is reserved up front. If the file can't be
+// created the chunks are discarded and the error is returned
+func createFile(f *ncproto.File) (io.WriteCloser, error) {
+	err := os.MkdirAll(filepath.Dir(f.FullFilePath(&conf)), 0775)
+	if err != nil {
+		return discardFile{}, err
+	}
+
+	fd, err := os.OpenFile(f.TempFilePath(&conf), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0775)
+	if err != nil {
+		return discardFile{}, err
+	}
+
+	if conf.Preallocate && 0 < f.FileSize {
+		err = preallocate(fd, f.FileSize)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "createFile: could not preallocate %s: %v\n", f.RelativeFilePath(&conf), err)
+		}
+	}
+
+	return fd, nil
+}
+
+// writeChunks writes every chunk queued for f to its FileDescriptor and to sum,
+// and returns the number of bytes written. After a failed write the remaining chunks are
+// drained so loop never blocks
+func writeChunks(srv *ncclient.Client, f *ncproto.File, sum io.Writer, report *transferReport) (int64, error) {
+	var werr error
+	var written int64
+	taken := 0
+	for chunk := range f.ChunkQueue {
+		// credits are granted in batches as soon as there is room in the queue
+		taken++
+		if ncproto.CreditWindow/2 <= taken {
+			srv.Grant(f, taken)
+			taken = 0
+		}
+
+		if werr != nil {
+			chunk.Release()
+			continue
+		}
+
+		started := time.Now()
+		n, err := f.FileDescriptor.Write(chunk.Data)
+		metrics.chunkWritten(f.ConnectionID, n, time.Since(started))
+		written += int64(n)
+		sum.Write(chunk.Data[:n])
+		report.written(n)
+		progress.Transferred(f.ID, n)
+		size := len(chunk.Data)
+		chunk.Release()
+		if err != nil {
+			werr = fmt.Errorf("error writing chunk %d to file %s: %v", chunk.Seq, f.RelativeFilePath(&conf), err)
+			continue
+		}
+
+		if n != size {
+			werr = fmt.Errorf("expected to write %d bytes but wrote %d bytes", size, n)
+		}
+	}
+
+	return written, werr
+}
+
+// commitFile moves a completely received file from its temporary path into place.
+// The file is only renamed once all announced bytes are written and synced to disk,
+// otherwise the temporary file is removed
+func commitFile(f *ncproto.File, written int64, werr error) error {
+	tmp := f.TempFilePath(&conf)
+	if werr == nil && written != f.FileSize {
+		werr = fmt.Errorf("received %d of %d bytes for %s", written, f.FileSize, f.RelativeFilePath(&conf))
+	}
+
+	if s, ok := f.FileDescriptor.(interface{ Sync() error }); ok && werr == nil {
+		werr = s.Sync()
+	}
+
+	err := f.FileDescriptor.Close()
+	if werr == nil {
+		werr = err
+	}
+
+	if werr != nil {
+		os.Remove(tmp)
+		return werr
+	}
+
+	if !f.ModTime.IsZero() {
+		err = os.Chtimes(tmp, f.ModTime, f.ModTime)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "commitFile: %v\n", err)
+		}
+	}
+
+	return os.Rename(tmp, f.FullFilePath(&conf))
+}
+
 func init() {
 	rootCmd.AddCommand(receiveCmd)
 
 	receiveCmd.Flags().Uint16VarP(&conf.Port, "port", "p", 0, "set the port to listen to. If not set a random, available port is selected")
+	addListenFlags(receiveCmd)
 	receiveCmd.Flags().StringVarP(&conf.WorkingDirectory, "working-dir", "d", ".", "set the directory to output files to")
 	receiveCmd.Flags().BoolVarP(&conf.Quiet, "quiet", "q", false, "don't print each received file nor transfer progress")
+	receiveCmd.Flags().StringVar(&conf.Output, "output", "text", "text, or json to print newline delimited events for scripts instead")
+	receiveCmd.Flags().StringVar(&conf.SummaryFile, "summary-file", "", "also write the end-of-transfer summary to this file")
+	receiveCmd.Flags().StringVar(&conf.MetricsAddr, "metrics-addr", "", "serve Prometheus metrics on this address (e.g. :9100) at /metrics")
+	receiveCmd.Flags().Var((*byteSize)(&conf.MaxBytes), "max-bytes", "abort when more than this many bytes (e.g. 10G) are sent. 0 means no limit")
+	receiveCmd.Flags().Uint64Var(&conf.MaxFiles, "max-files", 0, "abort when more than this many files are sent. 0 means no limit")
+	receiveCmd.Flags().Var((*byteSize)(&conf.MaxFileSize), "max-file-size", "abort when a single file is larger than this (e.g. 512M). 0 means no limit")
+	receiveCmd.Flags().Uint16Var(&conf.MaxDepth, "max-depth", 0, "abort when a file is nested deeper than this many directories. 0 means no limit")
+	receiveCmd.Flags().Uint16Var(&conf.MaxOpenFiles, "max-open-files", 0, "abort when more than this many files are transferred at once. 0 means no limit")
+	receiveCmd.Flags().StringVar(&conf.OnConflict, "on-conflict", conflictFail, fmt.Sprintf("what to do when a received file already exists. One of %s", strings.Join(conflictPolicies, ", ")))
+	receiveCmd.Flags().BoolVar(&conf.Delete, "delete", false, "delete files and directories not present on the sender, and those deleted on a sender in --watch mode. Implies --on-conflict overwrite unless set")
+	receiveCmd.Flags().BoolVar(&conf.DryRun, "dry-run", false, "only list what --delete would remove and abort the transfer")
+	receiveCmd.Flags().Uint16Var(&conf.MaxDelete, "max-delete", 50, "abort if --delete would remove more than this percentage of the existing entries")
+	addWriteFlags(receiveCmd)
 
 }
@@ -24,27 +24,47 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/bdoner/net-copy/ncproto"
+
 	"github.com/spf13/cobra"
 )
 
 var cfgFile string
 
 var rootCmd = &cobra.Command{
-	Use:   "net-copy",
-	Short: "A tool to copy files across the internet.",
+	Use:     "net-copy",
+	Version: ncproto.Version,
+	Short:   "A tool to copy files across the internet.",
 	Long: `
 	net-copy is used to copy files across the internet.
 
 	Often when working on remote machines the copy performance
 	is poor over RDP. This tool will provide better speeds by
-	doing concurrent copy operations to saturate the network.`,
+	doing concurrent copy operations to saturate the network.
+
+	Flags not given on the command line are read from environment
+	variables like NETCOPY_THREADS, then from the profile selected
+	with --profile and the defaults of the config file.`,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		err := loadConfig(cmd)
+		if err != nil {
+			return err
+		}
+
+		return setupOutput(cmd, args)
+	},
+}
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file with defaults and profiles (default $HOME/.config/net-copy/config.yaml)")
+	rootCmd.PersistentFlags().StringVar(&profile, "profile", "", "use the flags of this profile from the config file")
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
-		fmt.Println(err)
+		fmt.Fprintln(out, err)
 		os.Exit(1)
 	}
 }
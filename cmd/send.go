@@ -25,18 +25,22 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/bdoner/net-copy/ncproto/ncclient"
 
 	"github.com/google/uuid"
 
+	"github.com/bdoner/net-copy/internal/ncevent"
+	"github.com/bdoner/net-copy/internal/ncprogress"
 	"github.com/bdoner/net-copy/ncproto"
 
 	"github.com/spf13/cobra"
 )
 
-var conf ncproto.Config
+var conf = ncproto.Config{ReadBufferSize: 128 * 1024}
 
 var sendCmd = &cobra.Command{
 	Use:   "send",
@@ -45,52 +49,189 @@ var sendCmd = &cobra.Command{
 	Connects to a host, given by -a, using the port given by -p, then collects
 	a list of files to send. Once the connection is established net-copy will start
 	sending all the files recursively found in the working-directory (-d).
-	Once done the sender signals to the receiver it is done and the connection is closed.`,
+	Once done the sender signals to the receiver it is done and the connection is closed.
+
+	With --watch the connection is kept open after the initial copy and every
+	file created, modified, renamed or deleted in the working-directory is
+	replicated to the receiver until net-copy is interrupted. Deletions are
+	only carried out by a receiver started with --delete.`,
 	PreRun: setupWorkingDir,
-	RunE: func(cmd *cobra.Command, args []string) error {
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		defer func() { events.Summary(err) }()
 
-		cln, err := ncclient.Connect(conf.Hostname, conf.Port)
+		cln, err := ncclient.Connect(conf.Hostname, conf.Port, conf.PreferIP)
 		if err != nil {
 			return err
 		}
 
-		defer cln.Connection.Close()
+		defer cln.Close()
 
-		cln.SendMessage(conf)
+		events.SessionStart(conf.ConnectionID, "send", cln.Connection.RemoteAddr())
 
-		files := make([]ncproto.File, 0)
-		collectFiles(conf.WorkingDirectory, &files)
+		cln.Limiter, err = newRateLimiter()
+		if err != nil {
+			return err
+		}
 
-		fmt.Printf("found %d files to transfer\n", len(files))
+		cln.SendMessage(ncproto.NewSession(ncproto.ModeSend, &conf))
 
-		var wg sync.WaitGroup
-		filesChan := make(chan ncproto.File)
-		for i := uint16(0); i < conf.Threads; i++ {
-			go func() {
-				for file := range filesChan {
-					cln.SendFile(&file, &wg, &conf)
-				}
-			}()
+		// the receiver closes the connection once done or when aborting
+		var summary *ncproto.TransferSummary
+		var abortErr error
+		done := make(chan struct{})
+		go func() {
+			summary, abortErr = receiveErrors(cln)
+			close(done)
+		}()
+
+		files := make([]ncproto.File, 0)
+		collectFiles(&conf, conf.WorkingDirectory, &files)
+
+		fmt.Fprintf(out, "found %d files to transfer\n", len(files))
+		manifest := ncproto.NewManifest(files, &conf)
+		err = cln.SendMessage(manifest)
+		if err != nil {
+			return err
 		}
 
-		for _, file := range files {
-			filesChan <- file
+		if !conf.Quiet {
+			progress = ncprogress.New(out)
+			progress.SetTotal(manifest.Summary.FileCount, manifest.Summary.TotalBytes)
 		}
-		close(filesChan)
 
-		fmt.Println("waiting for last transfers to complete..")
-		wg.Wait()
+		cln.Reporter = fileReporter{progress: progress, events: events}
+		progress.Run()
+		failed := sendFiles(cln, files, &conf)
+		progress.Stop()
+		// files changed while watching are only listed
+		cln.Reporter = fileReporter{events: events}
+
+		if conf.Watch {
+			fmt.Fprintf(out, "watching %s for changes\n", conf.WorkingDirectory)
+			err = watchFiles(cln, done)
+			if err != nil {
+				return err
+			}
+		}
 
-		fmt.Println("all files sent. sending connection close")
+		fmt.Fprintln(out, "all files sent. sending connection close")
 		cln.SendMessage(ncproto.ConnectionClose{
 			ConnectionID: conf.ConnectionID,
 		})
 
+		<-done
+		if abortErr != nil {
+			return abortErr
+		}
+
+		reportSummary(*summary)
+		if 0 < len(failed) {
+			return fmt.Errorf("%d files could not be sent", len(failed))
+		}
+
+		if 0 < len(summary.Failed) {
+			return fmt.Errorf("the receiver failed to write %d files", len(summary.Failed))
+		}
+
 		return nil
 	},
 }
 
-func collectFiles(dir string, files *[]ncproto.File) {
+// receiveErrors reads the messages sent back by the receiver until the
+// connection is closed and returns the final summary. A connection closed
+// before the summary was sent is an error.
+// A SessionError closes the connection right away so all running transfers stop
+func receiveErrors(cln *ncclient.Client) (*ncproto.TransferSummary, error) {
+	var summary *ncproto.TransferSummary
+	for {
+		var message ncproto.INetCopyMessage
+		err := cln.GetNextMessage(&message)
+		if err != nil && summary == nil {
+			return nil, fmt.Errorf("connection closed before the receiver sent a summary: %v", err)
+		}
+
+		if err != nil {
+			return summary, nil
+		}
+
+		switch m := message.(type) {
+		case ncproto.TransferSummary:
+			summary = &m
+		case ncproto.SessionError:
+			cln.Close()
+			return nil, fmt.Errorf("receiver aborted the session: %s", m.Message)
+		}
+	}
+}
+
+// sendFiles sends all files using c.Threads concurrent transfers
+// and returns once every transfer has completed. It returns the
+// slash separated relative paths of the files that failed
+func sendFiles(cln *ncclient.Client, files []ncproto.File, c *ncproto.Config) []string {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failed := make([]string, 0)
+	filesChan := make(chan ncproto.File)
+	for i := uint16(0); i < c.Threads; i++ {
+		// each worker holds the group until it exits so Wait can not
+		// return before SendFile had a chance to register the last file
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range filesChan {
+				err := cln.SendFile(&file, &wg, c)
+				if err != nil {
+					mu.Lock()
+					failed = append(failed, filepath.ToSlash(file.RelativeFilePath(c)))
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for _, file := range files {
+		filesChan <- file
+	}
+	close(filesChan)
+
+	printf("waiting for last transfers to complete..\n")
+	wg.Wait()
+	return failed
+}
+
+// fileReporter shows the files sent by a client in the progress and the
+// event stream. Both may be nil
+type fileReporter struct {
+	progress *ncprogress.Tracker
+	events   *ncevent.Emitter
+}
+
+func (r fileReporter) FileStarted(f *ncproto.File, c *ncproto.Config) {
+	if !c.Quiet {
+		printf("%s (%s)\n", f.RelativeFilePath(c), f.PrettySize())
+	}
+
+	r.progress.FileStarted(f, c)
+	r.events.FileStart(filepath.ToSlash(f.RelativeFilePath(c)), f.FileSize)
+}
+
+func (r fileReporter) Transferred(f *ncproto.File, n int) {
+	r.progress.Transferred(f.ID, n)
+}
+
+func (r fileReporter) FileDone(f *ncproto.File, c *ncproto.Config, sent int64, started time.Time, sum []byte) {
+	r.progress.FileDone(f.ID)
+	r.events.FileDone(filepath.ToSlash(f.RelativeFilePath(c)), sent, started, sum)
+}
+
+func (r fileReporter) FileFailed(f *ncproto.File, c *ncproto.Config, err error) {
+	r.progress.FileDone(f.ID)
+	r.events.Error(filepath.ToSlash(f.RelativeFilePath(c)), err)
+}
+
+// collectFiles recursively adds every file found in dir to files.
+// Paths are made relative to the WorkingDirectory of c
+func collectFiles(c *ncproto.Config, dir string, files *[]ncproto.File) {
 	fs, err := ioutil.ReadDir(dir)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "collectFiles: error reading %s\n%v\n", dir, err)
@@ -98,20 +239,13 @@ func collectFiles(dir string, files *[]ncproto.File) {
 
 	for _, v := range fs {
 		if v.IsDir() {
-			collectFiles(filepath.Join(dir, v.Name()), files)
+			collectFiles(c, filepath.Join(dir, v.Name()), files)
 		} else {
-			rel, err := filepath.Rel(conf.WorkingDirectory, dir)
+			nf, err := newFile(c, dir, v)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "collectFiles: %v\n", err)
 				continue
 			}
-			nf := ncproto.File{
-				ID:           uuid.New(),
-				ConnectionID: conf.ConnectionID,
-				FileSize:     v.Size(),
-				Name:         v.Name(),
-				RelativePath: filepath.SplitList(rel),
-			}
 
 			*files = append(*files, nf)
 		}
@@ -119,18 +253,40 @@ func collectFiles(dir string, files *[]ncproto.File) {
 
 }
 
+// newFile describes the file v found in dir
+func newFile(c *ncproto.Config, dir string, v os.FileInfo) (ncproto.File, error) {
+	rel, err := filepath.Rel(c.WorkingDirectory, dir)
+	if err != nil {
+		return ncproto.File{}, err
+	}
+
+	return ncproto.File{
+		ID:           uuid.New(),
+		ConnectionID: c.ConnectionID,
+		FileSize:     v.Size(),
+		ModTime:      v.ModTime(),
+		Name:         v.Name(),
+		RelativePath: strings.Split(filepath.ToSlash(rel), "/"),
+	}, nil
+}
+
 func init() {
 	rootCmd.AddCommand(sendCmd)
 
-	sendCmd.Flags().StringVarP(&conf.Hostname, "host", "a", "", "define which host to connect to")
+	sendCmd.Flags().StringVarP(&conf.Hostname, "host", "a", "", "define which host to connect to. IPv6 addresses may be given in brackets")
+	sendCmd.Flags().StringVar(&conf.PreferIP, "prefer-ip", "", "try IPv4 (4) or IPv6 (6) addresses first when a host resolves to both")
 	sendCmd.Flags().Uint16VarP(&conf.Port, "port", "p", 0, "the port to connect to")
 	sendCmd.Flags().StringVarP(&conf.WorkingDirectory, "working-dir", "d", ".", "the directory to copy files from")
 	sendCmd.Flags().Uint16VarP(&conf.Threads, "threads", "t", 1, "define how many concurrent transfers to run")
 	sendCmd.Flags().BoolVarP(&conf.Quiet, "quiet", "q", false, "don't print each sent file nor transfer progress")
+	sendCmd.Flags().StringVar(&conf.Output, "output", "text", "text, or json to print newline delimited events for scripts instead")
+	sendCmd.Flags().StringVar(&conf.SummaryFile, "summary-file", "", "also write the end-of-transfer summary reported by the receiver to this file")
+	addSendFlags(sendCmd)
+	sendCmd.Flags().BoolVarP(&conf.Watch, "watch", "w", false, "keep the connection open and send changes to the working-dir as they happen")
+	sendCmd.Flags().DurationVar(&conf.Debounce, "debounce", 500*time.Millisecond, "how long a file must be left alone before a change is sent in --watch mode")
 	sendCmd.MarkFlagRequired("host")
 	sendCmd.MarkFlagRequired("port")
 
 	conf.ConnectionID = uuid.New()
-	conf.ReadBufferSize = 128 * 1024
 
 }
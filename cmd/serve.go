@@ -0,0 +1,271 @@
+// Copyright © 2019 Bdoner
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/google/uuid"
+
+	"github.com/bdoner/net-copy/ncproto"
+	"github.com/bdoner/net-copy/ncproto/ncclient"
+
+	"github.com/spf13/cobra"
+)
+
+// serveCmd represents the serve command
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Expose a directory read-only to ls and get",
+	Long: `
+	Serve opens a port (optionally given by -p) and exposes the working-directory (-d)
+	read-only. Any number of clients may connect and use ls to browse the directory
+	or get to fetch selected files and subtrees from it.`,
+	PreRun: setupWorkingDir,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		srv, err := ncclient.NewServer(&conf, readyFunc())
+		if err != nil {
+			return err
+		}
+
+		defer srv.Listener.Close()
+
+		limiter, err := newRateLimiter()
+		if err != nil {
+			return err
+		}
+
+		for {
+			cln, err := srv.Accept()
+			if err != nil {
+				return err
+			}
+
+			cln.Limiter = limiter
+			cln.Reporter = fileReporter{}
+			go serveClient(cln)
+		}
+	},
+}
+
+func serveClient(cln *ncclient.Client) {
+	defer cln.Close()
+
+	err := cln.Handshake()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "serveClient: %v\n", err)
+		return
+	}
+
+	var message ncproto.INetCopyMessage
+	err = cln.GetNextMessage(&message)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "serveClient: %v\n", err)
+		return
+	}
+
+	switch message.(type) {
+
+	case ncproto.ListRequest:
+		req := message.(ncproto.ListRequest)
+		listing, err := listPath(req.Path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "serveClient: %v\n", err)
+			cln.SendMessage(ncproto.SessionError{Message: err.Error()})
+			return
+		}
+
+		err = cln.SendMessage(listing)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "serveClient: %v\n", err)
+		}
+
+	case ncproto.GetRequest:
+		req := message.(ncproto.GetRequest)
+		if !conf.Quiet {
+			fmt.Fprintf(out, "%s requested %v\n", cln.Connection.RemoteAddr().String(), req.Paths)
+		}
+
+		// the client only sends credits back, which GetNextMessage hands to the files being sent
+		go func() {
+			var m ncproto.INetCopyMessage
+			for cln.GetNextMessage(&m) == nil {
+			}
+		}()
+
+		err := sendPaths(cln, req)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "serveClient: %v\n", err)
+			cln.SendMessage(ncproto.SessionError{ConnectionID: req.ConnectionID, Message: err.Error()})
+			return
+		}
+
+		cln.SendMessage(ncproto.ConnectionClose{ConnectionID: req.ConnectionID})
+
+	default:
+		fmt.Fprintf(os.Stderr, "serveClient: unexpected initial message %T from %s\n", message, cln.Connection.RemoteAddr().String())
+	}
+}
+
+// servedPath maps a slash separated remote path onto the served directory.
+// The path is cleaned as if rooted so it can never escape the working directory
+func servedPath(remotePath string) string {
+	return filepath.Join(conf.WorkingDirectory, filepath.FromSlash(path.Clean("/"+remotePath)))
+}
+
+// resolveServed follows the symlinks of p, a path inside the served directory,
+// and makes sure they don't lead outside of it
+func resolveServed(p string) error {
+	root, err := filepath.EvalSymlinks(conf.WorkingDirectory)
+	if err != nil {
+		return err
+	}
+
+	resolved, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return err
+	}
+
+	if !isInside(root, resolved) {
+		return fmt.Errorf("%s leads outside of the served directory", p)
+	}
+
+	return nil
+}
+
+func listPath(remotePath string) (ncproto.Listing, error) {
+	listing := ncproto.Listing{Path: path.Clean("/" + remotePath)}
+
+	p := servedPath(remotePath)
+	err := resolveServed(p)
+	if err != nil {
+		return listing, fmt.Errorf("could not list %s", listing.Path)
+	}
+
+	fi, err := os.Stat(p)
+	if err != nil {
+		return listing, fmt.Errorf("could not list %s", listing.Path)
+	}
+
+	fs := []os.FileInfo{fi}
+	if fi.IsDir() {
+		fs, err = ioutil.ReadDir(p)
+		if err != nil {
+			return listing, fmt.Errorf("could not list %s", listing.Path)
+		}
+	}
+
+	for _, v := range fs {
+		listing.Entries = append(listing.Entries, ncproto.ListEntry{
+			Name:    v.Name(),
+			Size:    v.Size(),
+			ModTime: v.ModTime(),
+			IsDir:   v.IsDir(),
+		})
+	}
+
+	return listing, nil
+}
+
+// sendPaths sends every requested file or subtree. Each path is sent
+// relative to its parent so the client receives it under its own name
+func sendPaths(cln *ncclient.Client, req ncproto.GetRequest) error {
+	type request struct {
+		conf  ncproto.Config
+		files []ncproto.File
+	}
+
+	requests := make([]request, 0, len(req.Paths))
+	for _, rp := range req.Paths {
+		r := request{conf: conf, files: make([]ncproto.File, 0)}
+		r.conf.ConnectionID = req.ConnectionID
+
+		p := servedPath(rp)
+		err := resolveServed(p)
+		if err != nil {
+			return fmt.Errorf("could not find %s", path.Clean("/"+rp))
+		}
+
+		fi, err := os.Stat(p)
+		if err != nil {
+			return fmt.Errorf("could not find %s", path.Clean("/"+rp))
+		}
+
+		if p != conf.WorkingDirectory {
+			r.conf.WorkingDirectory = filepath.Dir(p)
+		}
+
+		if fi.IsDir() {
+			collectFiles(&r.conf, p, &r.files)
+			r.files = servedFiles(&r.conf, r.files)
+		} else {
+			r.files = append(r.files, ncproto.File{
+				ID:           uuid.New(),
+				ConnectionID: req.ConnectionID,
+				FileSize:     fi.Size(),
+				ModTime:      fi.ModTime(),
+				Name:         fi.Name(),
+				RelativePath: []string{},
+			})
+		}
+
+		requests = append(requests, r)
+	}
+
+	for _, r := range requests {
+		sendFiles(cln, r.files, &r.conf)
+	}
+
+	return nil
+}
+
+// servedFiles drops the files found while walking a subtree which are
+// symlinks leading outside of the served directory
+func servedFiles(c *ncproto.Config, files []ncproto.File) []ncproto.File {
+	served := files[:0]
+	for _, f := range files {
+		err := resolveServed(f.FullFilePath(c))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "servedFiles: skipping %s: %v\n", f.RelativeFilePath(c), err)
+			continue
+		}
+
+		served = append(served, f)
+	}
+
+	return served
+}
+
+func init() {
+	rootCmd.AddCommand(serveCmd)
+
+	serveCmd.Flags().Uint16VarP(&conf.Port, "port", "p", 0, "set the port to listen to. If not set a random, available port is selected")
+	addListenFlags(serveCmd)
+	serveCmd.Flags().StringVarP(&conf.WorkingDirectory, "working-dir", "d", ".", "the directory to serve files from")
+	serveCmd.Flags().Uint16VarP(&conf.Threads, "threads", "t", 1, "define how many concurrent transfers to run per client")
+	addSendFlags(serveCmd)
+	serveCmd.Flags().BoolVarP(&conf.Quiet, "quiet", "q", false, "don't print each requested path nor sent file")
+
+}
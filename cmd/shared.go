@@ -1,13 +1,68 @@
 package cmd
 
 import (
+	"fmt"
 	"log"
+	"math"
+	"net"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bdoner/net-copy/internal/ncevent"
+	"github.com/bdoner/net-copy/ncproto"
+	"github.com/bdoner/net-copy/ncproto/ncclient"
 
 	"github.com/spf13/cobra"
 )
 
+// out is where messages, the progress and the summary are written
+var out = os.Stdout
+
+// setupOutput validates --output. With json the event stream is the only
+// thing written to stdout and every other message goes to stderr
+func setupOutput(cmd *cobra.Command, args []string) error {
+	switch conf.Output {
+	case "", "text":
+		return nil
+	case "json":
+		events = ncevent.New(os.Stdout)
+		out = os.Stderr
+		// the events replace the file list and the progress
+		conf.Quiet = true
+		return nil
+	}
+
+	return fmt.Errorf("unknown output %s. Use text or json", conf.Output)
+}
+
+// printf writes a message to out above the progress, if it is drawn
+func printf(format string, a ...interface{}) {
+	if progress == nil {
+		fmt.Fprintf(out, format, a...)
+		return
+	}
+
+	progress.Printf(format, a...)
+}
+
+// readyFunc returns how a listening server reports its address. It is nil,
+// so the address is printed, unless events are written
+func readyFunc() func(*net.TCPAddr) {
+	e := events
+	if e == nil && conf.ReadyEvent {
+		e = ncevent.New(os.Stdout)
+	}
+
+	if e == nil {
+		return nil
+	}
+
+	return e.Ready
+}
+
 func setupWorkingDir(cmd *cobra.Command, args []string) {
 	if conf.WorkingDirectory == "." {
 		wd, err := os.Getwd()
@@ -26,3 +81,226 @@ func setupWorkingDir(cmd *cobra.Command, args []string) {
 
 	}
 }
+
+// setupOutputDir makes sure the working directory exists
+// so received files can be written to it
+func setupOutputDir(cmd *cobra.Command, args []string) {
+	setupWorkingDir(cmd, args)
+
+	if conf.DryRun && !conf.Delete {
+		fmt.Fprintf(os.Stderr, "PreRun: --dry-run only lists what --delete would remove. Use it together with --delete\n")
+		os.Exit(-1)
+	}
+
+	if conf.Delete && !cmd.Flags().Changed("on-conflict") {
+		conf.OnConflict = conflictOverwrite
+	}
+
+	valid := false
+	for _, p := range conflictPolicies {
+		valid = valid || p == conf.OnConflict
+	}
+
+	if !valid {
+		fmt.Fprintf(os.Stderr, "PreRun: unknown --on-conflict policy %s. Use one of %s\n", conf.OnConflict, strings.Join(conflictPolicies, ", "))
+		os.Exit(-1)
+	}
+
+	_, err := os.Open(conf.WorkingDirectory)
+	if err != nil {
+		if os.IsNotExist(err) {
+			fmt.Fprintf(out, "Output directory does not exists. creating %s\n", conf.WorkingDirectory)
+			err := os.MkdirAll(conf.WorkingDirectory, 0775)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "PreRun: could not create output directory: %v\n", err)
+				os.Exit(-1)
+			}
+		} else {
+			fmt.Fprintf(os.Stderr, "PreRun: could not open output directory: %v\n", err)
+			os.Exit(-1)
+		}
+	}
+}
+
+// tempFileMaxAge is how long a temporary file must not have been written
+// to before it is taken for a leftover of an interrupted run
+const tempFileMaxAge = time.Hour
+
+// removeTempFiles cleans up after a previous run that was interrupted while
+// receiving files into dir. Only the temporary files named after a file ID
+// are removed, and only when they are older than tempFileMaxAge so a receiver
+// still writing into the same tree keeps its files. Without recursive only
+// dir itself is searched, not its subdirectories
+func removeTempFiles(dir string, recursive bool) {
+	filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "removeTempFiles: %v\n", err)
+			return nil
+		}
+
+		if fi.IsDir() && p != dir && !recursive {
+			return filepath.SkipDir
+		}
+
+		if !fi.IsDir() && ncproto.IsTempFileName(fi.Name()) && tempFileMaxAge < time.Since(fi.ModTime()) {
+			fmt.Fprintf(out, "removing incomplete file %s\n", p)
+			err = os.Remove(p)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "removeTempFiles: %v\n", err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// addListenFlags adds the flags of commands waiting for peers to connect
+func addListenFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&conf.PortRange, "port-range", "", "listen on the first free port in a range like 40000-40100")
+	cmd.Flags().StringVar(&conf.PortFile, "port-file", "", "write the port that is listened on to this file")
+	cmd.Flags().BoolVar(&conf.ReadyEvent, "ready-event", false, "print a JSON ready event with the bound address and port instead of the listening message")
+	cmd.Flags().StringVar(&conf.Bind, "bind", "", "the address of the interface to listen on. Listens on all interfaces if not set")
+	cmd.Flags().StringSliceVar(&conf.Allow, "allow", nil, "only accept connections from these addresses or CIDR ranges (e.g. 10.0.0.0/8). Can be repeated")
+}
+
+// addSendFlags adds the flags of commands sending files
+func addSendFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&conf.BWLimit, "bwlimit", "", "limit the bytes per second sent by all transfers (e.g. 50M) or follow a schedule like 08:00-18:00=10M,50M")
+	cmd.Flags().StringVar(&conf.BWLimitFile, "bwlimit-file", "", "read the --bwlimit value from this file. It is read again on SIGHUP")
+	cmd.Flags().Var(chunkSize{&conf}, "chunk-size", "how much of a file is sent per message (e.g. 512K), or auto to size chunks by file size and measured throughput")
+}
+
+// addWriteFlags adds the flags of commands receiving files
+func addWriteFlags(cmd *cobra.Command) {
+	cmd.Flags().Uint16Var(&conf.Writers, "writers", 16, "how many received files are written at once. Other files wait for a free writer")
+	cmd.Flags().BoolVar(&conf.Preallocate, "preallocate", false, "reserve the disk space of every received file before writing it. Only supported on Linux")
+}
+
+// parseRemote splits a remote location of the form host:port/path
+func parseRemote(remote string) (string, uint16, string, error) {
+	hostPort, path := remote, ""
+	// skip past a bracketed IPv6 literal before looking for the path
+	start := strings.LastIndex(remote, "]") + 1
+	if i := strings.Index(remote[start:], "/"); i != -1 {
+		hostPort, path = remote[:start+i], remote[start+i+1:]
+	}
+
+	host, p, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return "", 0, "", fmt.Errorf("invalid remote %s: %v", remote, err)
+	}
+
+	port, err := strconv.ParseUint(p, 10, 16)
+	if err != nil {
+		return "", 0, "", fmt.Errorf("invalid port in remote %s: %v", remote, err)
+	}
+
+	return host, uint16(port), path, nil
+}
+
+// byteSize is a flag value for sizes given as a number with an
+// optional K, M, G or T suffix (e.g. 512K or 10G)
+type byteSize uint64
+
+func (b *byteSize) String() string {
+	return strconv.FormatUint(uint64(*b), 10)
+}
+
+func (b *byteSize) Set(s string) error {
+	v, err := parseByteSize(s)
+	if err != nil {
+		return err
+	}
+
+	*b = byteSize(v)
+	return nil
+}
+
+func (b *byteSize) Type() string {
+	return "size"
+}
+
+// chunkSize is the flag value of --chunk-size. It is either a size
+// or auto to adapt the chunk size to every file and connection
+type chunkSize struct {
+	c *ncproto.Config
+}
+
+func (cs chunkSize) String() string {
+	if cs.c.AdaptiveChunks {
+		return "auto"
+	}
+
+	return strconv.FormatUint(uint64(cs.c.ReadBufferSize), 10)
+}
+
+func (cs chunkSize) Set(s string) error {
+	if strings.EqualFold(s, "auto") {
+		cs.c.AdaptiveChunks = true
+		cs.c.ReadBufferSize = ncclient.MaxChunkSize
+		return nil
+	}
+
+	v, err := parseByteSize(s)
+	if err != nil {
+		return err
+	}
+
+	if v == 0 || ncclient.MaxChunkSize < v {
+		return fmt.Errorf("chunk size must be between 1 and %d", ncclient.MaxChunkSize)
+	}
+
+	cs.c.AdaptiveChunks = false
+	cs.c.ReadBufferSize = uint32(v)
+	return nil
+}
+
+func (cs chunkSize) Type() string {
+	return "size"
+}
+
+// parseByteSize parses a size like 50M. Suffixes are powers of 1024
+func parseByteSize(s string) (uint64, error) {
+	units := map[string]uint64{"": 1, "B": 1, "K": 1 << 10, "M": 1 << 20, "G": 1 << 30, "T": 1 << 40}
+
+	str := strings.ToUpper(strings.TrimSpace(s))
+	str = strings.TrimSuffix(strings.TrimSuffix(str, "IB"), "B")
+	i := strings.IndexFunc(str, func(r rune) bool { return r < '0' || '9' < r })
+	if i == -1 {
+		i = len(str)
+	}
+
+	mul, ok := units[str[i:]]
+	if !ok || i == 0 {
+		return 0, fmt.Errorf("invalid size %s", s)
+	}
+
+	v, err := strconv.ParseUint(str[:i], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %s", s)
+	}
+
+	return v * mul, nil
+}
+
+// formatByteSize formats a size in the same powers of 1024 parseByteSize
+// reads, so limits are reported as they were given (e.g. 1K as 1KiB)
+func formatByteSize(size int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+
+	v, i := float64(size), 0
+	for 1024 <= v && i < len(units)-1 {
+		v /= 1024
+		i++
+	}
+
+	if v == math.Trunc(v) {
+		return fmt.Sprintf("%.0f%s", v, units[i])
+	}
+
+	return fmt.Sprintf("%.2f%s", v, units[i])
+}
@@ -0,0 +1,28 @@
+package cmd
+
+import "testing"
+
+func TestFormatByteSize(t *testing.T) {
+	tests := []struct {
+		flag string
+		want string
+	}{
+		{"512", "512B"},
+		{"1K", "1KiB"},
+		{"1536", "1.50KiB"},
+		{"10M", "10MiB"},
+		{"2G", "2GiB"},
+		{"3T", "3TiB"},
+	}
+
+	for _, tt := range tests {
+		v, err := parseByteSize(tt.flag)
+		if err != nil {
+			t.Fatalf("parseByteSize(%q): %v", tt.flag, err)
+		}
+
+		if got := formatByteSize(int64(v)); got != tt.want {
+			t.Errorf("formatByteSize(%d) = %s, want %s", v, got, tt.want)
+		}
+	}
+}
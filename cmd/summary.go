@@ -0,0 +1,164 @@
+// Copyright © 2019 Bdoner
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bdoner/net-copy/ncproto"
+)
+
+// transferReport collects the numbers of a TransferSummary while loop runs.
+// The peak rate is the highest rate measured over a full second
+type transferReport struct {
+	mu          sync.Mutex
+	summary     ncproto.TransferSummary
+	start       time.Time
+	windowStart time.Time
+	windowBytes int64
+}
+
+func newTransferReport() *transferReport {
+	now := time.Now()
+	return &transferReport{
+		summary:     ncproto.TransferSummary{ConnectionID: conf.ConnectionID},
+		start:       now,
+		windowStart: now,
+	}
+}
+
+// written records n bytes received for any file
+func (r *transferReport) written(n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.windowBytes += int64(n)
+
+	elapsed := time.Since(r.windowStart)
+	if elapsed < time.Second {
+		return
+	}
+
+	rate := int64(float64(r.windowBytes) / elapsed.Seconds())
+	if r.summary.PeakRate < rate {
+		r.summary.PeakRate = rate
+	}
+
+	r.windowStart, r.windowBytes = time.Now(), 0
+}
+
+func (r *transferReport) completed(path string, size int64, d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.summary.Files++
+	r.summary.Bytes += size
+	if r.summary.Largest.Path == "" || r.summary.Largest.Size < size {
+		r.summary.Largest = ncproto.FileResult{Path: path, Size: size, Duration: d}
+	}
+
+	if r.summary.Slowest.Path == "" || r.summary.Slowest.Duration < d {
+		r.summary.Slowest = ncproto.FileResult{Path: path, Size: size, Duration: d}
+	}
+}
+
+func (r *transferReport) failed(path string, size int64, reason error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.summary.Failed = append(r.summary.Failed, ncproto.FileResult{Path: path, Size: size, Reason: reason.Error()})
+}
+
+func (r *transferReport) skipped(path string, size int64, reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.summary.Skipped = append(r.summary.Skipped, ncproto.FileResult{Path: path, Size: size, Reason: reason})
+}
+
+// finish returns the summary once every file is written. Transfers
+// shorter than a second report their average rate as the peak
+func (r *transferReport) finish() ncproto.TransferSummary {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.summary.Elapsed = time.Since(r.start)
+	if r.summary.PeakRate == 0 && 0 < r.summary.Elapsed {
+		r.summary.PeakRate = int64(float64(r.summary.Bytes) / r.summary.Elapsed.Seconds())
+	}
+
+	return r.summary
+}
+
+// reportSummary prints s and writes it to --summary-file if given
+func reportSummary(s ncproto.TransferSummary) {
+	printSummary(out, s)
+
+	if conf.SummaryFile == "" {
+		return
+	}
+
+	fp, err := os.Create(conf.SummaryFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "reportSummary: could not write summary file: %v\n", err)
+		return
+	}
+	defer fp.Close()
+
+	printSummary(fp, s)
+}
+
+func printSummary(w io.Writer, s ncproto.TransferSummary) {
+	var average int64
+	if 0 < s.Elapsed {
+		average = int64(float64(s.Bytes) / s.Elapsed.Seconds())
+	}
+
+	fmt.Fprintf(w, "transfer summary\n")
+	fmt.Fprintf(w, "  files:    %d written, %d failed, %d skipped\n", s.Files, len(s.Failed), len(s.Skipped))
+	fmt.Fprintf(w, "  bytes:    %s\n", ncproto.PrettySize(s.Bytes))
+	fmt.Fprintf(w, "  elapsed:  %s\n", s.Elapsed.Round(time.Millisecond))
+	fmt.Fprintf(w, "  average:  %s/s\n", ncproto.PrettySize(average))
+	fmt.Fprintf(w, "  peak:     %s/s\n", ncproto.PrettySize(s.PeakRate))
+
+	if s.Largest.Path != "" {
+		fmt.Fprintf(w, "  largest:  %s (%s)\n", s.Largest.Path, ncproto.PrettySize(s.Largest.Size))
+		fmt.Fprintf(w, "  slowest:  %s (%s)\n", s.Slowest.Path, s.Slowest.Duration.Round(time.Millisecond))
+	}
+
+	if 0 < len(s.Failed) {
+		fmt.Fprintf(w, "  failed:\n")
+		for _, f := range s.Failed {
+			fmt.Fprintf(w, "    %s: %s\n", f.Path, f.Reason)
+		}
+	}
+
+	if 0 < len(s.Skipped) {
+		fmt.Fprintf(w, "  skipped:\n")
+		for _, f := range s.Skipped {
+			fmt.Fprintf(w, "    %s: %s\n", f.Path, f.Reason)
+		}
+	}
+}
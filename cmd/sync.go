@@ -0,0 +1,449 @@
+// Copyright © 2019 Bdoner
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/bdoner/net-copy/internal/ncprogress"
+	"github.com/bdoner/net-copy/ncproto"
+	"github.com/bdoner/net-copy/ncproto/ncclient"
+
+	"github.com/spf13/cobra"
+)
+
+// syncStateFile keeps the manifest agreed on by the last sync.
+// It is stored in the root of the working directory and never synced itself
+const syncStateFile = ".net-copy-sync"
+
+// syncCmd represents the sync command
+var syncCmd = &cobra.Command{
+	Use:   "sync",
+	Short: "Synchronize a directory with a peer in both directions",
+	Long: `
+	Sync exchanges the file manifests of two working-directories (-d) and
+	transfers changed files in both directions over a single connection.
+	One peer listens (no -a given) and the other connects to it using -a and -p.
+
+	A file is considered changed when its size or modification time differs from
+	the version recorded by the last sync. Files changed on both sides, or differing
+	on the first sync, are reported as conflicts and left untouched on both sides.
+	Resolve a conflict by removing the copy you don't want to keep.
+	Deletions are not propagated; a file removed on one side is copied back.`,
+	SilenceUsage: true,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		setupWorkingDir(cmd, args)
+		removeTempFiles(conf.WorkingDirectory, true)
+	},
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		defer func() { events.Summary(err) }()
+
+		// the sync plan already decided which copy wins
+		conf.OnConflict = conflictOverwrite
+
+		if conf.Hostname == "" {
+			return syncListen()
+		}
+
+		return syncConnect()
+	},
+}
+
+func syncConnect() error {
+	cln, err := ncclient.Connect(conf.Hostname, conf.Port, conf.PreferIP)
+	if err != nil {
+		return err
+	}
+
+	defer cln.Close()
+
+	events.SessionStart(conf.ConnectionID, "sync", cln.Connection.RemoteAddr())
+
+	cln.Limiter, err = newRateLimiter()
+	if err != nil {
+		return err
+	}
+
+	cln.SendMessage(ncproto.NewSession(ncproto.ModeSync, &conf))
+
+	files := collectSyncFiles()
+	local := ncproto.NewManifest(files, &conf)
+	err = cln.SendMessage(local)
+	if err != nil {
+		return err
+	}
+
+	remote, err := receiveManifest(cln)
+	if err != nil {
+		return err
+	}
+
+	state := loadSyncState()
+	plan := planSync(local, remote, state)
+	err = cln.SendMessage(plan)
+	if err != nil {
+		return err
+	}
+
+	failed, err := exchangeFiles(cln, files, plan.Upload, plan.Download)
+	if err != nil {
+		return err
+	}
+
+	saveSyncState(newSyncState(local, remote, plan, state, failed))
+	return reportSync(plan, failed)
+}
+
+func syncListen() error {
+	srv, err := ncclient.Listen(&conf, readyFunc())
+	if err != nil {
+		return err
+	}
+
+	defer srv.Close()
+
+	srv.Limiter, err = newRateLimiter()
+	if err != nil {
+		return err
+	}
+
+	err = receiveSession(srv, ncproto.ModeSync)
+	if err != nil {
+		return err
+	}
+
+	events.SessionStart(conf.ConnectionID, "sync", srv.Connection.RemoteAddr())
+
+	remote, err := receiveManifest(srv)
+	if err != nil {
+		return err
+	}
+
+	files := collectSyncFiles()
+	local := ncproto.NewManifest(files, &conf)
+	err = srv.SendMessage(local)
+	if err != nil {
+		return err
+	}
+
+	var message ncproto.INetCopyMessage
+	err = srv.GetNextMessage(&message)
+	if err != nil {
+		return err
+	}
+
+	plan, ok := message.(ncproto.SyncPlan)
+	if !ok || plan.ConnectionID != conf.ConnectionID {
+		return fmt.Errorf("expected a sync plan but got %T", message)
+	}
+
+	failed, err := exchangeFiles(srv, files, plan.Download, plan.Upload)
+	if err != nil {
+		return err
+	}
+
+	// the plan is always made from the connecting side's point of view
+	saveSyncState(newSyncState(remote, local, plan, loadSyncState(), failed))
+	return reportSync(plan, failed)
+}
+
+// exchangeFiles sends the files found in paths while receiving the files
+// in incoming from the peer. It returns once both sides are done with the
+// paths of every file that failed on either side
+func exchangeFiles(cln *ncclient.Client, files []ncproto.File, paths, incoming []string) (map[string]bool, error) {
+	want := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		want[p] = true
+	}
+
+	// the peer may only send what the plan says, conflicts are never overwritten
+	allowed := make(map[string]bool, len(incoming))
+	for _, p := range incoming {
+		allowed[p] = true
+	}
+
+	outgoing := make([]ncproto.File, 0, len(paths))
+	for _, f := range files {
+		if want[filepath.ToSlash(f.RelativeFilePath(&conf))] {
+			outgoing = append(outgoing, f)
+		}
+	}
+
+	fmt.Fprintf(out, "sending %d files\n", len(outgoing))
+
+	if !conf.Quiet {
+		progress = ncprogress.New(out)
+	}
+	cln.Reporter = fileReporter{progress: progress, events: events}
+
+	var sendFailed []string
+	done := make(chan struct{})
+	go func() {
+		sendFailed = sendFiles(cln, outgoing, &conf)
+		cln.SendMessage(ncproto.ConnectionClose{ConnectionID: conf.ConnectionID})
+		close(done)
+	}()
+
+	s, err := loop(cln, allowed)
+	if err != nil {
+		return nil, err
+	}
+
+	// the peer grants credits until it received every file, so messages are
+	// read while the files are still sent. The next one is the summary of the
+	// peer which tells which of the sent files it failed to write
+	type reply struct {
+		message ncproto.INetCopyMessage
+		err     error
+	}
+	replies := make(chan reply, 1)
+	go func() {
+		var message ncproto.INetCopyMessage
+		err := cln.GetNextMessage(&message)
+		replies <- reply{message, err}
+	}()
+
+	<-done
+
+	cln.SendMessage(s)
+	r := <-replies
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	ps, ok := r.message.(ncproto.TransferSummary)
+	if !ok {
+		return nil, fmt.Errorf("expected a transfer summary but got %T", r.message)
+	}
+
+	failed := make(map[string]bool)
+	for _, p := range sendFailed {
+		failed[p] = true
+	}
+	for _, f := range append(s.Failed, ps.Failed...) {
+		failed[f.Path] = true
+	}
+
+	return failed, nil
+}
+
+func collectSyncFiles() []ncproto.File {
+	files := make([]ncproto.File, 0)
+	collectFiles(&conf, conf.WorkingDirectory, &files)
+
+	for i, f := range files {
+		if f.RelativeFilePath(&conf) == syncStateFile {
+			return append(files[:i], files[i+1:]...)
+		}
+	}
+
+	return files
+}
+
+// planSync compares the manifest of the connecting peer (local) with the one
+// of the listening peer (remote) against the state recorded by the last sync
+func planSync(local, remote ncproto.Manifest, state map[string]ncproto.ManifestEntry) ncproto.SyncPlan {
+	plan := ncproto.SyncPlan{ConnectionID: conf.ConnectionID}
+	lm := manifestIndex(local)
+	rm := manifestIndex(remote)
+
+	// changed reports whether e differs from the version agreed on last time
+	changed := func(e ncproto.ManifestEntry) bool {
+		base, found := state[e.Path]
+		return !found || !e.Same(&base)
+	}
+
+	for _, p := range manifestPaths(lm, rm) {
+		l, lfound := lm[p]
+		r, rfound := rm[p]
+
+		switch {
+		case !rfound:
+			plan.Upload = append(plan.Upload, p)
+		case !lfound:
+			plan.Download = append(plan.Download, p)
+		case l.Same(&r):
+			continue
+		case changed(l) && !changed(r):
+			plan.Upload = append(plan.Upload, p)
+		case !changed(l) && changed(r):
+			plan.Download = append(plan.Download, p)
+		default:
+			plan.Conflicts = append(plan.Conflicts, p)
+		}
+	}
+
+	return plan
+}
+
+// newSyncState works out the manifest both peers agree on once plan is carried out.
+// Conflicting and failed paths keep their old state so they are handled again next time
+func newSyncState(local, remote ncproto.Manifest, plan ncproto.SyncPlan, state map[string]ncproto.ManifestEntry, failed map[string]bool) map[string]ncproto.ManifestEntry {
+	lm := manifestIndex(local)
+	rm := manifestIndex(remote)
+
+	ns := make(map[string]ncproto.ManifestEntry)
+	for _, p := range plan.Conflicts {
+		if base, found := state[p]; found {
+			ns[p] = base
+		}
+		delete(lm, p)
+		delete(rm, p)
+	}
+
+	for _, p := range plan.Download {
+		delete(lm, p)
+	}
+
+	for p, e := range rm {
+		ns[p] = e
+	}
+
+	// uploaded and identical files
+	for p, e := range lm {
+		ns[p] = e
+	}
+
+	for p := range failed {
+		delete(ns, p)
+		if base, found := state[p]; found {
+			ns[p] = base
+		}
+	}
+
+	return ns
+}
+
+func reportSync(plan ncproto.SyncPlan, failed map[string]bool) error {
+	if len(plan.Conflicts) == 0 && len(failed) == 0 {
+		fmt.Fprintln(out, "sync complete")
+		return nil
+	}
+
+	for _, p := range plan.Conflicts {
+		fmt.Fprintf(os.Stderr, "conflict: %s changed on both sides\n", p)
+	}
+
+	paths := make([]string, 0, len(failed))
+	for p := range failed {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		fmt.Fprintf(os.Stderr, "failed: %s was not copied\n", p)
+	}
+
+	if len(failed) != 0 {
+		return fmt.Errorf("sync incomplete with %d failed files and %d conflicts left untouched", len(failed), len(plan.Conflicts))
+	}
+
+	return fmt.Errorf("sync complete with %d conflicts left untouched", len(plan.Conflicts))
+}
+
+func manifestIndex(m ncproto.Manifest) map[string]ncproto.ManifestEntry {
+	idx := make(map[string]ncproto.ManifestEntry, len(m.Entries))
+	for _, e := range m.Entries {
+		idx[e.Path] = e
+	}
+
+	return idx
+}
+
+// manifestPaths returns the sorted union of all paths in the given manifests
+func manifestPaths(manifests ...map[string]ncproto.ManifestEntry) []string {
+	seen := make(map[string]bool)
+	paths := make([]string, 0)
+	for _, m := range manifests {
+		for p := range m {
+			if !seen[p] {
+				seen[p] = true
+				paths = append(paths, p)
+			}
+		}
+	}
+
+	sort.Strings(paths)
+	return paths
+}
+
+func loadSyncState() map[string]ncproto.ManifestEntry {
+	state := make(map[string]ncproto.ManifestEntry)
+
+	data, err := ioutil.ReadFile(filepath.Join(conf.WorkingDirectory, syncStateFile))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "loadSyncState: %v\n", err)
+		}
+		return state
+	}
+
+	var entries []ncproto.ManifestEntry
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "loadSyncState: ignoring corrupt state: %v\n", err)
+		return state
+	}
+
+	for _, e := range entries {
+		state[e.Path] = e
+	}
+
+	return state
+}
+
+func saveSyncState(state map[string]ncproto.ManifestEntry) {
+	entries := make([]ncproto.ManifestEntry, 0, len(state))
+	for _, p := range manifestPaths(state) {
+		entries = append(entries, state[p])
+	}
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "saveSyncState: %v\n", err)
+		return
+	}
+
+	err = ioutil.WriteFile(filepath.Join(conf.WorkingDirectory, syncStateFile), data, 0664)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "saveSyncState: %v\n", err)
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(syncCmd)
+
+	syncCmd.Flags().StringVarP(&conf.Hostname, "host", "a", "", "the host to connect to. If not set sync listens for the peer to connect")
+	syncCmd.Flags().StringVar(&conf.PreferIP, "prefer-ip", "", "try IPv4 (4) or IPv6 (6) addresses first when a host resolves to both")
+	syncCmd.Flags().Uint16VarP(&conf.Port, "port", "p", 0, "the port to connect or listen to")
+	addListenFlags(syncCmd)
+	syncCmd.Flags().StringVarP(&conf.WorkingDirectory, "working-dir", "d", ".", "the directory to synchronize")
+	syncCmd.Flags().Uint16VarP(&conf.Threads, "threads", "t", 1, "define how many concurrent transfers to run")
+	addSendFlags(syncCmd)
+	syncCmd.Flags().BoolVarP(&conf.Quiet, "quiet", "q", false, "don't print each transferred file")
+	syncCmd.Flags().StringVar(&conf.Output, "output", "text", "text, or json to print newline delimited events for scripts instead")
+	addWriteFlags(syncCmd)
+
+}
@@ -0,0 +1,268 @@
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/bdoner/net-copy/ncproto"
+	"github.com/bdoner/net-copy/ncproto/ncclient"
+)
+
+// connectPair returns both ends of a connection which completed the handshake
+func connectPair(t *testing.T) (*ncclient.Client, *ncclient.Client) {
+	srv, err := ncclient.NewServer(&ncproto.Config{Bind: "127.0.0.1"}, func(*net.TCPAddr) {})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer srv.Listener.Close()
+
+	accepted := make(chan *ncclient.Client, 1)
+	go func() {
+		c, err := srv.Accept()
+		if err != nil {
+			t.Errorf("Accept: %v", err)
+			accepted <- nil
+			return
+		}
+
+		err = c.Handshake()
+		if err != nil {
+			t.Errorf("Handshake: %v", err)
+		}
+		accepted <- c
+	}()
+
+	cln, err := ncclient.Connect("127.0.0.1", uint16(srv.Listener.Addr().(*net.TCPAddr).Port), "")
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+
+	peer := <-accepted
+	if peer == nil {
+		t.FailNow()
+	}
+
+	return cln, peer
+}
+
+// TestExchangeFilesOneSided uploads a file of many chunks to a peer which has
+// nothing to send, so the uploader is done receiving long before it is done sending
+func TestExchangeFilesOneSided(t *testing.T) {
+	defer func(c ncproto.Config) { conf = c }(conf)
+
+	dir, err := ioutil.TempDir("", "net-copy-sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := bytes.Repeat([]byte("net-copy"), 128*1024)
+	err = ioutil.WriteFile(filepath.Join(dir, "big.bin"), data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf = ncproto.Config{
+		WorkingDirectory: dir,
+		ConnectionID:     uuid.New(),
+		ReadBufferSize:   64 * 1024,
+		Threads:          1,
+		Quiet:            true,
+		OnConflict:       conflictOverwrite,
+	}
+
+	cln, peer := connectPair(t)
+	defer cln.Close()
+	defer peer.Close()
+
+	// the peer receives the file and sends nothing itself
+	received := make(chan int64, 1)
+	go func() {
+		peer.SendMessage(ncproto.ConnectionClose{ConnectionID: conf.ConnectionID})
+
+		var n int64
+		files := make(map[uuid.UUID]*ncproto.File)
+		for {
+			var message ncproto.INetCopyMessage
+			if peer.GetNextMessage(&message) != nil {
+				received <- -1
+				return
+			}
+
+			switch m := message.(type) {
+			case ncproto.File:
+				files[m.ID] = &m
+			case ncproto.FileChunk:
+				n += int64(len(m.Data))
+				peer.Grant(files[m.ID], 1)
+			case ncproto.ConnectionClose:
+				peer.SendMessage(ncproto.TransferSummary{ConnectionID: conf.ConnectionID})
+				received <- n
+				return
+			}
+		}
+	}()
+
+	type result struct {
+		failed map[string]bool
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		failed, err := exchangeFiles(cln, collectSyncFiles(), []string{"big.bin"}, nil)
+		done <- result{failed, err}
+	}()
+
+	select {
+	case r := <-done:
+		if r.err != nil {
+			t.Fatalf("exchangeFiles: %v", r.err)
+		}
+
+		if len(r.failed) != 0 {
+			t.Errorf("failed files %v", r.failed)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("exchangeFiles did not return")
+	}
+
+	if n := <-received; n != int64(len(data)) {
+		t.Errorf("peer received %d bytes, want %d", n, len(data))
+	}
+}
+
+// TestLoopRejectsUnplannedFiles makes sure a peer can't overwrite a file
+// the sync plan doesn't allow it to send, like a conflict
+func TestLoopRejectsUnplannedFiles(t *testing.T) {
+	defer func(c ncproto.Config) { conf = c }(conf)
+
+	dir, err := ioutil.TempDir("", "net-copy-sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "conflict.txt"), []byte("mine"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf = ncproto.Config{
+		WorkingDirectory: dir,
+		ConnectionID:     uuid.New(),
+		Quiet:            true,
+		OnConflict:       conflictOverwrite,
+	}
+
+	cln, peer := connectPair(t)
+	defer cln.Close()
+	defer peer.Close()
+
+	go func() {
+		for _, name := range []string{"conflict.txt", "download.txt"} {
+			data := []byte("theirs")
+			f := ncproto.File{ID: uuid.New(), ConnectionID: conf.ConnectionID, FileSize: int64(len(data)), Name: name, RelativePath: []string{}}
+			peer.SendMessage(f)
+			peer.SendMessage(ncproto.FileChunk{ID: f.ID, ConnectionID: conf.ConnectionID, Data: data})
+			peer.SendMessage(ncproto.FileComplete{ID: f.ID, ConnectionID: conf.ConnectionID})
+		}
+		peer.SendMessage(ncproto.ConnectionClose{ConnectionID: conf.ConnectionID})
+	}()
+
+	s, err := loop(cln, map[string]bool{"download.txt": true})
+	if err != nil {
+		t.Fatalf("loop: %v", err)
+	}
+
+	if len(s.Failed) != 1 || s.Failed[0].Path != "conflict.txt" {
+		t.Errorf("failed files %v, want conflict.txt", s.Failed)
+	}
+
+	for name, want := range map[string]string{"conflict.txt": "mine", "download.txt": "theirs"} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(data) != want {
+			t.Errorf("%s holds %q (%v), want %q", name, data, err, want)
+		}
+	}
+}
+
+func entry(p string, size int64) ncproto.ManifestEntry {
+	return ncproto.ManifestEntry{Path: p, Size: size, ModTime: time.Unix(1700000000, 0)}
+}
+
+func manifest(entries ...ncproto.ManifestEntry) ncproto.Manifest {
+	return ncproto.Manifest{Entries: entries}
+}
+
+func TestPlanSync(t *testing.T) {
+	tests := []struct {
+		name                        string
+		local, remote               ncproto.Manifest
+		state                       []ncproto.ManifestEntry
+		upload, download, conflicts []string
+	}{
+		{"NewOnEitherSide", manifest(entry("a", 1)), manifest(entry("b", 1)), nil, []string{"a"}, []string{"b"}, nil},
+		{"Identical", manifest(entry("a", 1)), manifest(entry("a", 1)), nil, nil, nil, nil},
+		{"IdenticalWithoutState", manifest(entry("a", 1)), manifest(entry("a", 1)), []ncproto.ManifestEntry{entry("a", 9)}, nil, nil, nil},
+		{"ChangedLocally", manifest(entry("a", 2)), manifest(entry("a", 1)), []ncproto.ManifestEntry{entry("a", 1)}, []string{"a"}, nil, nil},
+		{"ChangedRemotely", manifest(entry("a", 1)), manifest(entry("a", 2)), []ncproto.ManifestEntry{entry("a", 1)}, nil, []string{"a"}, nil},
+		{"ChangedOnBothSides", manifest(entry("a", 2)), manifest(entry("a", 3)), []ncproto.ManifestEntry{entry("a", 1)}, nil, nil, []string{"a"}},
+		{"DifferentWithoutState", manifest(entry("a", 2)), manifest(entry("a", 3)), nil, nil, nil, []string{"a"}},
+		{"Sorted", manifest(entry("c", 1), entry("a", 1)), manifest(entry("b", 1)), nil, []string{"a", "c"}, []string{"b"}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := manifestIndex(manifest(tt.state...))
+			plan := planSync(tt.local, tt.remote, state)
+
+			if !reflect.DeepEqual(plan.Upload, tt.upload) || !reflect.DeepEqual(plan.Download, tt.download) || !reflect.DeepEqual(plan.Conflicts, tt.conflicts) {
+				t.Errorf("got upload %v, download %v, conflicts %v, want %v, %v, %v", plan.Upload, plan.Download, plan.Conflicts, tt.upload, tt.download, tt.conflicts)
+			}
+		})
+	}
+}
+
+func TestNewSyncState(t *testing.T) {
+	tests := []struct {
+		name          string
+		local, remote ncproto.Manifest
+		state         []ncproto.ManifestEntry
+		failed        []string
+		want          []ncproto.ManifestEntry
+	}{
+		{"Copied", manifest(entry("a", 1)), manifest(entry("b", 1)), nil, nil, []ncproto.ManifestEntry{entry("a", 1), entry("b", 1)}},
+		{"Uploaded", manifest(entry("a", 2)), manifest(entry("a", 1)), []ncproto.ManifestEntry{entry("a", 1)}, nil, []ncproto.ManifestEntry{entry("a", 2)}},
+		{"Downloaded", manifest(entry("a", 1)), manifest(entry("a", 2)), []ncproto.ManifestEntry{entry("a", 1)}, nil, []ncproto.ManifestEntry{entry("a", 2)}},
+		{"ConflictKeepsState", manifest(entry("a", 2)), manifest(entry("a", 3)), []ncproto.ManifestEntry{entry("a", 1)}, nil, []ncproto.ManifestEntry{entry("a", 1)}},
+		{"ConflictWithoutState", manifest(entry("a", 2)), manifest(entry("a", 3)), nil, nil, []ncproto.ManifestEntry{}},
+		{"FailedKeepsState", manifest(entry("a", 2)), manifest(entry("a", 1)), []ncproto.ManifestEntry{entry("a", 1)}, []string{"a"}, []ncproto.ManifestEntry{entry("a", 1)}},
+		{"FailedWithoutState", manifest(entry("a", 1)), manifest(), nil, []string{"a"}, []ncproto.ManifestEntry{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := manifestIndex(manifest(tt.state...))
+			failed := make(map[string]bool)
+			for _, p := range tt.failed {
+				failed[p] = true
+			}
+
+			plan := planSync(tt.local, tt.remote, state)
+			got := newSyncState(tt.local, tt.remote, plan, state, failed)
+
+			want := manifestIndex(manifest(tt.want...))
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright © 2019 Bdoner
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/bdoner/net-copy/ncproto"
+	"github.com/bdoner/net-copy/ncproto/ncclient"
+)
+
+// watchFiles replicates every change in the working directory to the receiver.
+// A path is sent once it has been left alone for conf.Debounce. It returns
+// when interrupted or once done is closed
+func watchFiles(cln *ncclient.Client, done <-chan struct{}) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	defer w.Close()
+
+	err = addWatches(w, conf.WorkingDirectory, nil)
+	if err != nil {
+		return err
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
+
+	tick := conf.Debounce / 2
+	if tick <= 0 {
+		tick = 10 * time.Millisecond
+	}
+
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	// pending maps a changed path to the time of its latest event
+	pending := make(map[string]time.Time)
+	for {
+		select {
+		case ev, ok := <-w.Events:
+			if !ok {
+				return nil
+			}
+
+			pending[ev.Name] = time.Now()
+
+			if ev.Op&fsnotify.Create == fsnotify.Create {
+				fi, err := os.Lstat(ev.Name)
+				if err == nil && fi.IsDir() {
+					// files may have been created before the watch was in place
+					err = addWatches(w, ev.Name, pending)
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "watchFiles: %v\n", err)
+					}
+				}
+			}
+
+		case err, ok := <-w.Errors:
+			if !ok {
+				return nil
+			}
+			fmt.Fprintf(os.Stderr, "watchFiles: %v\n", err)
+
+		case now := <-ticker.C:
+			for p, t := range pending {
+				if now.Sub(t) < conf.Debounce {
+					continue
+				}
+
+				delete(pending, p)
+				sendChange(cln, p)
+			}
+
+		case <-done:
+			return nil
+
+		case <-interrupt:
+			fmt.Fprintln(out, "interrupted. stopping watch")
+			return nil
+		}
+	}
+}
+
+// addWatches watches dir and all directories below it. Files found
+// are added to pending when it is given
+func addWatches(w *fsnotify.Watcher, dir string, pending map[string]time.Time) error {
+	return filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if fi.IsDir() {
+			return w.Add(p)
+		}
+
+		if pending != nil {
+			pending[p] = time.Now()
+		}
+
+		return nil
+	})
+}
+
+// sendChange sends the current state of p. Paths that no longer exist
+// are deleted on the receiver and directories are left to their files
+func sendChange(cln *ncclient.Client, p string) {
+	rel, err := filepath.Rel(conf.WorkingDirectory, p)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sendChange: %v\n", err)
+		return
+	}
+
+	fi, err := os.Lstat(p)
+	if os.IsNotExist(err) {
+		if !conf.Quiet {
+			fmt.Fprintf(out, "deleting %s\n", rel)
+		}
+
+		cln.SendMessage(ncproto.FileDelete{
+			ConnectionID: conf.ConnectionID,
+			Path:         filepath.ToSlash(rel),
+		})
+		return
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sendChange: %v\n", err)
+		return
+	}
+
+	if !fi.Mode().IsRegular() {
+		return
+	}
+
+	file, err := newFile(&conf, filepath.Dir(p), fi)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sendChange: %v\n", err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	cln.SendFile(&file, &wg, &conf)
+}
@@ -0,0 +1,88 @@
+// Copyright © 2019 Bdoner
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import "sync"
+
+// writerPool writes received files on a fixed number of goroutines so only
+// that many files are open at once. Files wait for a free writer in the order
+// they were announced. A pool of size 0 writes every file right away
+type writerPool struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	size   int
+	jobs   []func()
+	closed bool
+}
+
+func newWriterPool(size int) *writerPool {
+	p := &writerPool{size: size}
+	p.cond = sync.NewCond(&p.mu)
+
+	for i := 0; i < size; i++ {
+		go p.work()
+	}
+
+	return p
+}
+
+// submit queues a job without blocking
+func (p *writerPool) submit(job func()) {
+	if p.size == 0 {
+		go job()
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.jobs = append(p.jobs, job)
+	p.cond.Signal()
+}
+
+// close stops the writers once every queued job is done
+func (p *writerPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	p.cond.Broadcast()
+}
+
+func (p *writerPool) work() {
+	for {
+		p.mu.Lock()
+		for len(p.jobs) == 0 && !p.closed {
+			p.cond.Wait()
+		}
+
+		if len(p.jobs) == 0 {
+			p.mu.Unlock()
+			return
+		}
+
+		job := p.jobs[0]
+		p.jobs = p.jobs[1:]
+		p.mu.Unlock()
+
+		job()
+	}
+}
@@ -0,0 +1,213 @@
+package ncevent
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Names of the events written to the stream
+const (
+	Ready        = "ready"
+	SessionStart = "session_start"
+	FileStart    = "file_start"
+	FileDone     = "file_done"
+	Error        = "error"
+	Summary      = "summary"
+)
+
+// ReadyEvent is written once a listening socket is open
+type ReadyEvent struct {
+	Event   string `json:"event"`
+	Address string `json:"address"`
+	Host    string `json:"host"`
+	Port    int    `json:"port"`
+}
+
+// SessionStartEvent is written once a peer is connected
+type SessionStartEvent struct {
+	Event   string    `json:"event"`
+	Time    time.Time `json:"time"`
+	Session string    `json:"session"`
+	Role    string    `json:"role"`
+	Peer    string    `json:"peer"`
+}
+
+// FileStartEvent is written when a file starts transferring
+type FileStartEvent struct {
+	Event   string    `json:"event"`
+	Time    time.Time `json:"time"`
+	Session string    `json:"session"`
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+}
+
+// FileDoneEvent is written when a file has been completely sent or written
+type FileDoneEvent struct {
+	Event      string    `json:"event"`
+	Time       time.Time `json:"time"`
+	Session    string    `json:"session"`
+	Path       string    `json:"path"`
+	Bytes      int64     `json:"bytes"`
+	DurationMS int64     `json:"duration_ms"`
+	SHA256     string    `json:"sha256"`
+}
+
+// ErrorEvent is written for every failed file and for errors ending
+// the session, in which case Path is empty
+type ErrorEvent struct {
+	Event   string    `json:"event"`
+	Time    time.Time `json:"time"`
+	Session string    `json:"session,omitempty"`
+	Path    string    `json:"path,omitempty"`
+	Message string    `json:"message"`
+}
+
+// SummaryEvent is always the last event of a run
+type SummaryEvent struct {
+	Event      string    `json:"event"`
+	Time       time.Time `json:"time"`
+	Session    string    `json:"session,omitempty"`
+	Success    bool      `json:"success"`
+	Files      int64     `json:"files"`
+	Failed     int64     `json:"failed"`
+	Bytes      int64     `json:"bytes"`
+	DurationMS int64     `json:"duration_ms"`
+}
+
+// Emitter writes events as newline delimited JSON and keeps count of
+// the files it reported for the summary.
+// All methods may be called on a nil Emitter, which writes nothing
+type Emitter struct {
+	mu      sync.Mutex
+	enc     *json.Encoder
+	session string
+	start   time.Time
+	files   int64
+	failed  int64
+	bytes   int64
+}
+
+// New creates an Emitter writing to w
+func New(w io.Writer) *Emitter {
+	return &Emitter{enc: json.NewEncoder(w), start: time.Now()}
+}
+
+// Ready reports the address a server is listening on
+func (e *Emitter) Ready(addr *net.TCPAddr) {
+	e.emit(ReadyEvent{
+		Event:   Ready,
+		Address: addr.String(),
+		Host:    addr.IP.String(),
+		Port:    addr.Port,
+	})
+}
+
+// SessionStart reports a connected peer. role is the command running
+func (e *Emitter) SessionStart(session uuid.UUID, role string, peer net.Addr) {
+	if e == nil {
+		return
+	}
+
+	e.mu.Lock()
+	e.session, e.start = session.String(), time.Now()
+	e.mu.Unlock()
+
+	e.emit(SessionStartEvent{Event: SessionStart, Time: time.Now(), Session: session.String(), Role: role, Peer: peer.String()})
+}
+
+// FileStart reports a file about to be transferred
+func (e *Emitter) FileStart(path string, size int64) {
+	if e == nil {
+		return
+	}
+
+	e.emit(FileStartEvent{Event: FileStart, Time: time.Now(), Session: e.getSession(), Path: path, Size: size})
+}
+
+// FileDone reports a transferred file, how long it took since started and its sha256 sum
+func (e *Emitter) FileDone(path string, bytes int64, started time.Time, sum []byte) {
+	if e == nil {
+		return
+	}
+
+	e.mu.Lock()
+	e.files++
+	e.bytes += bytes
+	e.mu.Unlock()
+
+	e.emit(FileDoneEvent{
+		Event:      FileDone,
+		Time:       time.Now(),
+		Session:    e.getSession(),
+		Path:       path,
+		Bytes:      bytes,
+		DurationMS: time.Since(started).Milliseconds(),
+		SHA256:     hex.EncodeToString(sum),
+	})
+}
+
+// Error reports err. A path marks the file as failed
+func (e *Emitter) Error(path string, err error) {
+	if e == nil {
+		return
+	}
+
+	if path != "" {
+		e.mu.Lock()
+		e.failed++
+		e.mu.Unlock()
+	}
+
+	e.emit(ErrorEvent{Event: Error, Time: time.Now(), Session: e.getSession(), Path: path, Message: err.Error()})
+}
+
+// Summary ends the stream. A non nil err is reported as an error first
+func (e *Emitter) Summary(err error) {
+	if e == nil {
+		return
+	}
+
+	if err != nil {
+		e.Error("", err)
+	}
+
+	e.mu.Lock()
+	s := SummaryEvent{
+		Event:      Summary,
+		Time:       time.Now(),
+		Session:    e.session,
+		Success:    err == nil && e.failed == 0,
+		Files:      e.files,
+		Failed:     e.failed,
+		Bytes:      e.bytes,
+		DurationMS: time.Since(e.start).Milliseconds(),
+	}
+	e.mu.Unlock()
+
+	e.emit(s)
+}
+
+func (e *Emitter) getSession() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.session
+}
+
+func (e *Emitter) emit(ev interface{}) {
+	if e == nil {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// an event that can't be written is lost, the transfer goes on
+	e.enc.Encode(ev)
+}
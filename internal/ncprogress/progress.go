@@ -0,0 +1,287 @@
+package ncprogress
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/bdoner/net-copy/ncproto"
+)
+
+const (
+	barWidth     = 25
+	nameWidth    = 50
+	ttyInterval  = 200 * time.Millisecond
+	lineInterval = 5 * time.Second
+)
+
+// Tracker aggregates the progress of all transfers of a session and
+// draws it to a terminal. When the output is not a terminal a plain
+// status line is printed periodically instead.
+// All methods may be called on a nil Tracker, which only prints messages
+type Tracker struct {
+	mu         sync.Mutex
+	out        *os.File
+	tty        bool
+	totalFiles int64
+	totalBytes int64
+	files      int64
+	bytes      int64
+	active     map[uuid.UUID]*transfer
+	order      []uuid.UUID
+	start      time.Time
+	lastBytes  int64
+	lastTick   time.Time
+	rate       float64
+	drawn      int
+	stop       chan struct{}
+	stopped    chan struct{}
+}
+
+type transfer struct {
+	file  ncproto.File
+	name  string
+	bytes int64
+}
+
+// New creates a Tracker drawing to out
+func New(out *os.File) *Tracker {
+	tty := false
+	if fi, err := out.Stat(); err == nil {
+		tty = fi.Mode()&os.ModeCharDevice != 0
+	}
+
+	return &Tracker{
+		out:    out,
+		tty:    tty,
+		active: make(map[uuid.UUID]*transfer),
+	}
+}
+
+// SetTotal sets the number of files and bytes expected in this session
+func (t *Tracker) SetTotal(files, bytes int64) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.totalFiles, t.totalBytes = files, bytes
+}
+
+// Run starts drawing the progress until Stop is called
+func (t *Tracker) Run() {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	t.start, t.lastTick = time.Now(), time.Now()
+	t.stop, t.stopped = make(chan struct{}), make(chan struct{})
+	t.mu.Unlock()
+
+	interval := lineInterval
+	if t.tty {
+		interval = ttyInterval
+	}
+
+	go func() {
+		defer close(t.stopped)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				t.mu.Lock()
+				t.sample()
+				t.draw(false)
+				t.mu.Unlock()
+			case <-t.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop draws the final progress and stops drawing
+func (t *Tracker) Stop() {
+	if t == nil || t.stop == nil {
+		return
+	}
+
+	close(t.stop)
+	<-t.stopped
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.sample()
+	t.draw(true)
+	t.stop = nil
+}
+
+// FileStarted adds a file to the active transfers
+func (t *Tracker) FileStarted(f *ncproto.File, c *ncproto.Config) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.active[f.ID] = &transfer{file: *f, name: f.RelativeFilePath(c)}
+	t.order = append(t.order, f.ID)
+}
+
+// Transferred records n more bytes sent or received for a file
+func (t *Tracker) Transferred(id uuid.UUID, n int) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.bytes += int64(n)
+	if tr, found := t.active[id]; found {
+		tr.bytes += int64(n)
+	}
+}
+
+// FileDone removes a file from the active transfers
+func (t *Tracker) FileDone(id uuid.UUID) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, found := t.active[id]; !found {
+		return
+	}
+
+	t.files++
+	delete(t.active, id)
+	for i, o := range t.order {
+		if o == id {
+			t.order = append(t.order[:i], t.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// Printf prints a message above the progress. On a terminal the
+// progress is drawn again right away
+func (t *Tracker) Printf(format string, a ...interface{}) {
+	if t == nil {
+		fmt.Printf(format, a...)
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.clear()
+	fmt.Fprintf(t.out, format, a...)
+	if t.tty && t.stop != nil {
+		t.draw(false)
+	}
+}
+
+// Println prints a message above the progress
+func (t *Tracker) Println(a ...interface{}) {
+	t.Printf("%s", fmt.Sprintln(a...))
+}
+
+// sample updates the smoothed throughput
+func (t *Tracker) sample() {
+	now := time.Now()
+	elapsed := now.Sub(t.lastTick).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+
+	current := float64(t.bytes-t.lastBytes) / elapsed
+	if t.rate == 0 {
+		t.rate = current
+	} else {
+		t.rate = 0.7*t.rate + 0.3*current
+	}
+
+	t.lastBytes, t.lastTick = t.bytes, now
+}
+
+func (t *Tracker) clear() {
+	if t.tty && 0 < t.drawn {
+		fmt.Fprintf(t.out, "\033[%dA\r\033[J", t.drawn)
+	}
+	t.drawn = 0
+}
+
+func (t *Tracker) draw(final bool) {
+	t.clear()
+
+	lines := []string{t.summary(final)}
+	if t.tty && !final {
+		for _, id := range t.order {
+			tr := t.active[id]
+			bar, percent := tr.file.GetProgress(tr.bytes, barWidth)
+			lines = append(lines, fmt.Sprintf("  %s %3d%% %s", bar, percent, shorten(tr.name)))
+		}
+	}
+
+	for _, l := range lines {
+		fmt.Fprintln(t.out, l)
+	}
+
+	if t.tty && !final {
+		t.drawn = len(lines)
+	}
+}
+
+func (t *Tracker) summary(final bool) string {
+	var sb strings.Builder
+
+	if 0 < t.totalFiles {
+		fmt.Fprintf(&sb, "files %d/%d  ", t.files, t.totalFiles)
+	} else {
+		fmt.Fprintf(&sb, "files %d  ", t.files)
+	}
+
+	if 0 < t.totalBytes {
+		fmt.Fprintf(&sb, "%s/%s (%d%%)  ", ncproto.PrettySize(t.bytes), ncproto.PrettySize(t.totalBytes), t.bytes*100/t.totalBytes)
+	} else {
+		fmt.Fprintf(&sb, "%s  ", ncproto.PrettySize(t.bytes))
+	}
+
+	elapsed := time.Since(t.start)
+	if final {
+		avg := float64(t.bytes) / elapsed.Seconds()
+		fmt.Fprintf(&sb, "%s/s  done in %s", ncproto.PrettySize(int64(avg)), elapsed.Round(time.Second))
+		return sb.String()
+	}
+
+	fmt.Fprintf(&sb, "%s/s  elapsed %s", ncproto.PrettySize(int64(t.rate)), elapsed.Round(time.Second))
+	if 0 < t.totalBytes && 0 < t.rate && t.bytes < t.totalBytes {
+		eta := time.Duration(float64(t.totalBytes-t.bytes) / t.rate * float64(time.Second))
+		fmt.Fprintf(&sb, "  ETA %s", eta.Round(time.Second))
+	}
+
+	return sb.String()
+}
+
+func shorten(name string) string {
+	if len(name) <= nameWidth {
+		return name
+	}
+
+	return "..." + name[len(name)-nameWidth+3:]
+}
@@ -0,0 +1,263 @@
+package ncproto
+
+import "fmt"
+
+// message writes the payload of msg and returns its type ID.
+// Fields are written in the order they are listed in PROTOCOL.md
+func (w *writer) message(msg INetCopyMessage) (uint8, error) {
+	switch m := msg.(type) {
+	case File:
+		w.uuid(m.ID)
+		w.uuid(m.ConnectionID)
+		w.i64(m.FileSize)
+		w.time(m.ModTime)
+		w.string(m.Name)
+		w.strings(m.RelativePath)
+		return TypeFile, nil
+
+	case FileChunk:
+		w.uuid(m.ID)
+		w.uuid(m.ConnectionID)
+		w.u64(uint64(m.Seq))
+		w.bytes(m.Data)
+		return TypeFileChunk, nil
+
+	case FileComplete:
+		w.uuid(m.ID)
+		w.uuid(m.ConnectionID)
+		w.bytes(m.Checksum)
+		return TypeFileComplete, nil
+
+	case ConnectionClose:
+		w.uuid(m.ConnectionID)
+		return TypeConnectionClose, nil
+
+	case ListRequest:
+		w.string(m.Path)
+		return TypeListRequest, nil
+
+	case Listing:
+		w.string(m.Path)
+		w.u32(uint32(len(m.Entries)))
+		for _, e := range m.Entries {
+			w.string(e.Name)
+			w.i64(e.Size)
+			w.time(e.ModTime)
+			w.bool(e.IsDir)
+		}
+		return TypeListing, nil
+
+	case GetRequest:
+		w.uuid(m.ConnectionID)
+		w.strings(m.Paths)
+		return TypeGetRequest, nil
+
+	case SessionError:
+		w.uuid(m.ConnectionID)
+		w.string(m.Message)
+		return TypeSessionError, nil
+
+	case FileDelete:
+		w.uuid(m.ConnectionID)
+		w.string(m.Path)
+		return TypeFileDelete, nil
+
+	case Manifest:
+		w.uuid(m.ConnectionID)
+		w.i64(m.Summary.TotalBytes)
+		w.i64(m.Summary.FileCount)
+		w.string(m.Summary.LargestPath)
+		w.i64(m.Summary.LargestSize)
+		w.u32(uint32(len(m.Entries)))
+		for _, e := range m.Entries {
+			w.string(e.Path)
+			w.i64(e.Size)
+			w.time(e.ModTime)
+		}
+		return TypeManifest, nil
+
+	case SyncPlan:
+		w.uuid(m.ConnectionID)
+		w.strings(m.Upload)
+		w.strings(m.Download)
+		w.strings(m.Conflicts)
+		return TypeSyncPlan, nil
+
+	case TransferSummary:
+		w.uuid(m.ConnectionID)
+		w.i64(m.Files)
+		w.i64(m.Bytes)
+		w.duration(m.Elapsed)
+		w.i64(m.PeakRate)
+		w.fileResults(m.Failed)
+		w.fileResults(m.Skipped)
+		w.fileResult(m.Largest)
+		w.fileResult(m.Slowest)
+		return TypeTransferSummary, nil
+
+	case Hello:
+		w.u16(m.MinVersion)
+		w.u16(m.MaxVersion)
+		w.string(m.Software)
+		w.strings(m.Capabilities)
+		return TypeHello, nil
+
+	case Session:
+		w.uuid(m.ConnectionID)
+		w.string(m.Mode)
+		return TypeSession, nil
+
+	case Credit:
+		w.uuid(m.ID)
+		w.uuid(m.ConnectionID)
+		w.u32(m.Chunks)
+		return TypeCredit, nil
+	}
+
+	return 0, fmt.Errorf("can't encode message of type %T", msg)
+}
+
+// message reads the payload of a message of type t
+func (r *reader) message(t uint8) INetCopyMessage {
+	switch t {
+	case TypeFile:
+		return File{
+			ID:           r.uuid(),
+			ConnectionID: r.uuid(),
+			FileSize:     r.i64(),
+			ModTime:      r.time(),
+			Name:         r.string(),
+			RelativePath: r.strings(),
+		}
+
+	case TypeFileChunk:
+		return FileChunk{
+			ID:           r.uuid(),
+			ConnectionID: r.uuid(),
+			Seq:          int(r.u64()),
+			Data:         r.bytes(),
+		}
+
+	case TypeFileComplete:
+		return FileComplete{ID: r.uuid(), ConnectionID: r.uuid(), Checksum: r.bytes()}
+
+	case TypeConnectionClose:
+		return ConnectionClose{ConnectionID: r.uuid()}
+
+	case TypeListRequest:
+		return ListRequest{Path: r.string()}
+
+	case TypeListing:
+		m := Listing{Path: r.string()}
+		n := r.count()
+		m.Entries = make([]ListEntry, 0, n)
+		for i := 0; i < n; i++ {
+			m.Entries = append(m.Entries, ListEntry{
+				Name:    r.string(),
+				Size:    r.i64(),
+				ModTime: r.time(),
+				IsDir:   r.bool(),
+			})
+		}
+		return m
+
+	case TypeGetRequest:
+		return GetRequest{ConnectionID: r.uuid(), Paths: r.strings()}
+
+	case TypeSessionError:
+		return SessionError{ConnectionID: r.uuid(), Message: r.string()}
+
+	case TypeFileDelete:
+		return FileDelete{ConnectionID: r.uuid(), Path: r.string()}
+
+	case TypeManifest:
+		m := Manifest{
+			ConnectionID: r.uuid(),
+			Summary: ManifestSummary{
+				TotalBytes:  r.i64(),
+				FileCount:   r.i64(),
+				LargestPath: r.string(),
+				LargestSize: r.i64(),
+			},
+		}
+		n := r.count()
+		m.Entries = make([]ManifestEntry, 0, n)
+		for i := 0; i < n; i++ {
+			m.Entries = append(m.Entries, ManifestEntry{
+				Path:    r.string(),
+				Size:    r.i64(),
+				ModTime: r.time(),
+			})
+		}
+		return m
+
+	case TypeSyncPlan:
+		return SyncPlan{
+			ConnectionID: r.uuid(),
+			Upload:       r.strings(),
+			Download:     r.strings(),
+			Conflicts:    r.strings(),
+		}
+
+	case TypeTransferSummary:
+		return TransferSummary{
+			ConnectionID: r.uuid(),
+			Files:        r.i64(),
+			Bytes:        r.i64(),
+			Elapsed:      r.duration(),
+			PeakRate:     r.i64(),
+			Failed:       r.fileResults(),
+			Skipped:      r.fileResults(),
+			Largest:      r.fileResult(),
+			Slowest:      r.fileResult(),
+		}
+
+	case TypeHello:
+		return Hello{
+			MinVersion:   r.u16(),
+			MaxVersion:   r.u16(),
+			Software:     r.string(),
+			Capabilities: r.strings(),
+		}
+
+	case TypeSession:
+		return Session{ConnectionID: r.uuid(), Mode: r.string()}
+
+	case TypeCredit:
+		return Credit{ID: r.uuid(), ConnectionID: r.uuid(), Chunks: r.u32()}
+	}
+
+	return UnknownMessage{Type: t}
+}
+
+func (w *writer) fileResult(f FileResult) {
+	w.string(f.Path)
+	w.i64(f.Size)
+	w.duration(f.Duration)
+	w.string(f.Reason)
+}
+
+func (r *reader) fileResult() FileResult {
+	return FileResult{
+		Path:     r.string(),
+		Size:     r.i64(),
+		Duration: r.duration(),
+		Reason:   r.string(),
+	}
+}
+
+func (w *writer) fileResults(v []FileResult) {
+	w.u32(uint32(len(v)))
+	for _, f := range v {
+		w.fileResult(f)
+	}
+}
+
+func (r *reader) fileResults() []FileResult {
+	n := r.count()
+	v := make([]FileResult, 0, n)
+	for i := 0; i < n; i++ {
+		v = append(v, r.fileResult())
+	}
+	return v
+}
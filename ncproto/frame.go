@@ -0,0 +1,436 @@
+package ncproto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ProtocolVersion is the highest protocol version this package speaks. See PROTOCOL.md
+const ProtocolVersion = 1
+
+// HelloVersion is written in the header of Hello frames whatever version the peers
+// speak, so any peer can read them before a version is negotiated
+const HelloVersion = 1
+
+// HeaderSize is the size of the header in front of every frame
+const HeaderSize = 6
+
+// MaxPayloadSize is the largest payload a frame may carry
+const MaxPayloadSize = 16 * 1024 * 1024
+
+// MaxMessageSize is the largest payload of a message split over several frames
+const MaxMessageSize = 256 * 1024 * 1024
+
+// Message type IDs written in the frame header
+const (
+	// TypeConfig is obsolete. Older versions sent their whole Config, which
+	// is now replaced by Session. The ID is not reused
+	TypeConfig          uint8 = 1
+	TypeFile            uint8 = 2
+	TypeFileChunk       uint8 = 3
+	TypeFileComplete    uint8 = 4
+	TypeConnectionClose uint8 = 5
+	TypeListRequest     uint8 = 6
+	TypeListing         uint8 = 7
+	TypeGetRequest      uint8 = 8
+	TypeSessionError    uint8 = 9
+	TypeFileDelete      uint8 = 10
+	TypeManifest        uint8 = 11
+	TypeSyncPlan        uint8 = 12
+	TypeTransferSummary uint8 = 13
+	TypeHello           uint8 = 14
+	TypeSession         uint8 = 15
+	TypeCredit          uint8 = 16
+	// TypeContinued frames carry the first parts of a payload too large
+	// for a single frame. The last part follows in a frame of the actual type
+	TypeContinued uint8 = 17
+)
+
+// UnknownMessage is decoded from a frame of a type this version doesn't know.
+// The frame is skipped so the rest of the stream can still be read
+type UnknownMessage struct {
+	Type uint8
+}
+
+var errShortPayload = errors.New("payload is shorter than its fields")
+
+// chunkBuffers holds the payload buffers of decoded FileChunks handed back with Release
+var chunkBuffers sync.Pool
+
+// Encoder writes messages as frames
+type Encoder struct {
+	w       io.Writer
+	version uint8
+}
+
+// NewEncoder returns an Encoder writing frames of ProtocolVersion to w
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w, version: ProtocolVersion}
+}
+
+// SetVersion sets the version written in the header of every following frame
+// but Hello frames. It must not be called while messages are encoded
+func (e *Encoder) SetVersion(v uint8) {
+	e.version = v
+}
+
+// Encode writes msg as a single frame
+func (e *Encoder) Encode(msg INetCopyMessage) error {
+	frame, err := e.Frame(msg)
+	if err != nil {
+		return err
+	}
+
+	return e.WriteFrame(frame)
+}
+
+// Frame returns msg encoded as frames without writing them. A payload larger
+// than MaxPayloadSize is split over several frames, which must be written
+// together. It fails if the message can't be encoded or exceeds MaxMessageSize
+func (e *Encoder) Frame(msg INetCopyMessage) ([]byte, error) {
+	p := writer{b: make([]byte, HeaderSize, HeaderSize+payloadSizeHint(msg))}
+	t, err := p.message(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	version := e.version
+	if t == TypeHello {
+		version = HelloVersion
+	}
+
+	size := len(p.b) - HeaderSize
+	if size <= MaxPayloadSize {
+		putHeader(p.b, version, t, size)
+		return p.b, nil
+	}
+
+	if MaxMessageSize < size {
+		return nil, fmt.Errorf("payload of %d bytes exceeds the maximum of %d bytes", size, MaxMessageSize)
+	}
+
+	payload := p.b[HeaderSize:]
+	frames := make([]byte, 0, size+(size/MaxPayloadSize+1)*HeaderSize)
+	for MaxPayloadSize < len(payload) {
+		frames = appendFrame(frames, version, TypeContinued, payload[:MaxPayloadSize])
+		payload = payload[MaxPayloadSize:]
+	}
+
+	return appendFrame(frames, version, t, payload), nil
+}
+
+func putHeader(b []byte, version, t uint8, size int) {
+	b[0] = version
+	b[1] = t
+	binary.BigEndian.PutUint32(b[2:], uint32(size))
+}
+
+func appendFrame(b []byte, version, t uint8, payload []byte) []byte {
+	var header [HeaderSize]byte
+	putHeader(header[:], version, t, len(payload))
+	return append(append(b, header[:]...), payload...)
+}
+
+// WriteFrame writes a frame returned by Frame
+func (e *Encoder) WriteFrame(frame []byte) error {
+	_, err := e.w.Write(frame)
+	return err
+}
+
+// Decoder reads frames written by an Encoder
+type Decoder struct {
+	r       io.Reader
+	version uint8
+}
+
+// NewDecoder returns a Decoder reading frames of ProtocolVersion from r
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: r, version: ProtocolVersion}
+}
+
+// SetVersion sets the version every following frame but Hello frames must have.
+// It must not be called while messages are decoded
+func (d *Decoder) SetVersion(v uint8) {
+	d.version = v
+}
+
+// Decode reads the next message. The parts of a message split over
+// several frames are read and joined before it is decoded
+func (d *Decoder) Decode() (INetCopyMessage, error) {
+	var parts []byte
+	for {
+		t, buf, err := d.readFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		if t == TypeContinued {
+			if MaxMessageSize < len(parts)+len(*buf) {
+				return nil, fmt.Errorf("payload exceeds the maximum of %d bytes", MaxMessageSize)
+			}
+
+			parts = append(parts, *buf...)
+			continue
+		}
+
+		if parts != nil {
+			parts = append(parts, *buf...)
+			buf = &parts
+		}
+
+		r := reader{b: *buf}
+		msg := r.message(t)
+		if r.err != nil {
+			return nil, fmt.Errorf("invalid message of type %d: %v", t, r.err)
+		}
+
+		// the Data of a chunk points into the payload, which it keeps until released
+		if c, ok := msg.(FileChunk); ok {
+			c.buf = buf
+			msg = c
+		}
+
+		return msg, nil
+	}
+}
+
+// readFrame reads a single frame and returns its type and payload
+func (d *Decoder) readFrame() (uint8, *[]byte, error) {
+	var header [HeaderSize]byte
+	_, err := io.ReadFull(d.r, header[:])
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// a Hello can be read whatever version it is framed with
+	if header[0] != d.version && header[1] != TypeHello {
+		return 0, nil, fmt.Errorf("unsupported protocol version %d", header[0])
+	}
+
+	size := binary.BigEndian.Uint32(header[2:])
+	if MaxPayloadSize < size {
+		return 0, nil, fmt.Errorf("payload of %d bytes exceeds the maximum of %d bytes", size, MaxPayloadSize)
+	}
+
+	buf := newPayload(header[1], int(size))
+	_, err = io.ReadFull(d.r, *buf)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return header[1], buf, nil
+}
+
+// newPayload returns a buffer of size bytes. Buffers of FileChunks are
+// taken from chunkBuffers if one is large enough
+func newPayload(t uint8, size int) *[]byte {
+	if t == TypeFileChunk {
+		if b, ok := chunkBuffers.Get().(*[]byte); ok && size <= cap(*b) {
+			*b = (*b)[:size]
+			return b
+		}
+	}
+
+	b := make([]byte, size)
+	return &b
+}
+
+// Release hands the buffer of a chunk read by a Decoder back for reuse.
+// The Data of c must not be used afterwards
+func (c *FileChunk) Release() {
+	if c.buf == nil {
+		return
+	}
+
+	chunkBuffers.Put(c.buf)
+	c.buf, c.Data = nil, nil
+}
+
+func payloadSizeHint(msg INetCopyMessage) int {
+	if c, ok := msg.(FileChunk); ok {
+		return len(c.Data) + 64
+	}
+
+	return 256
+}
+
+// writer appends the fields of a payload in big endian byte order
+type writer struct {
+	b []byte
+}
+
+func (w *writer) u8(v uint8) {
+	w.b = append(w.b, v)
+}
+
+func (w *writer) u16(v uint16) {
+	w.b = binary.BigEndian.AppendUint16(w.b, v)
+}
+
+func (w *writer) u32(v uint32) {
+	w.b = binary.BigEndian.AppendUint32(w.b, v)
+}
+
+func (w *writer) u64(v uint64) {
+	w.b = binary.BigEndian.AppendUint64(w.b, v)
+}
+
+func (w *writer) i64(v int64) {
+	w.u64(uint64(v))
+}
+
+func (w *writer) bool(v bool) {
+	if v {
+		w.u8(1)
+	} else {
+		w.u8(0)
+	}
+}
+
+func (w *writer) bytes(v []byte) {
+	w.u32(uint32(len(v)))
+	w.b = append(w.b, v...)
+}
+
+func (w *writer) string(v string) {
+	w.u32(uint32(len(v)))
+	w.b = append(w.b, v...)
+}
+
+func (w *writer) strings(v []string) {
+	w.u32(uint32(len(v)))
+	for _, s := range v {
+		w.string(s)
+	}
+}
+
+func (w *writer) uuid(v uuid.UUID) {
+	w.b = append(w.b, v[:]...)
+}
+
+// time is written as nanoseconds since the unix epoch. The zero time is written as 0
+func (w *writer) time(v time.Time) {
+	if v.IsZero() {
+		w.i64(0)
+		return
+	}
+
+	w.i64(v.UnixNano())
+}
+
+func (w *writer) duration(v time.Duration) {
+	w.i64(int64(v))
+}
+
+// reader reads the fields of a payload. The first error is kept
+// and every following read returns a zero value
+type reader struct {
+	b   []byte
+	err error
+}
+
+func (r *reader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+
+	if len(r.b) < n {
+		r.err = errShortPayload
+		return nil
+	}
+
+	v := r.b[:n:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *reader) u8() uint8 {
+	if v := r.take(1); v != nil {
+		return v[0]
+	}
+	return 0
+}
+
+func (r *reader) u16() uint16 {
+	if v := r.take(2); v != nil {
+		return binary.BigEndian.Uint16(v)
+	}
+	return 0
+}
+
+func (r *reader) u32() uint32 {
+	if v := r.take(4); v != nil {
+		return binary.BigEndian.Uint32(v)
+	}
+	return 0
+}
+
+func (r *reader) u64() uint64 {
+	if v := r.take(8); v != nil {
+		return binary.BigEndian.Uint64(v)
+	}
+	return 0
+}
+
+func (r *reader) i64() int64 {
+	return int64(r.u64())
+}
+
+func (r *reader) bool() bool {
+	return r.u8() != 0
+}
+
+func (r *reader) bytes() []byte {
+	return r.take(int(r.u32()))
+}
+
+func (r *reader) string() string {
+	return string(r.bytes())
+}
+
+// count reads the length of a list. Every item takes at least one byte
+// so a length longer than the rest of the payload is rejected right away
+func (r *reader) count() int {
+	n := int(r.u32())
+	if r.err == nil && len(r.b) < n {
+		r.err = errShortPayload
+		return 0
+	}
+	return n
+}
+
+func (r *reader) strings() []string {
+	n := r.count()
+	v := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		v = append(v, r.string())
+	}
+	return v
+}
+
+func (r *reader) uuid() uuid.UUID {
+	var v uuid.UUID
+	copy(v[:], r.take(len(v)))
+	return v
+}
+
+func (r *reader) time() time.Time {
+	ns := r.i64()
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+func (r *reader) duration() time.Duration {
+	return time.Duration(r.i64())
+}
@@ -0,0 +1,191 @@
+package ncproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestRoundTrip(t *testing.T) {
+	id, conn := uuid.New(), uuid.New()
+	when := time.Unix(1700000000, 123)
+	result := FileResult{Path: "a/b.txt", Size: 42, Duration: time.Second, Reason: "reason"}
+
+	tests := []struct {
+		name string
+		msg  INetCopyMessage
+	}{
+		{"File", File{ID: id, ConnectionID: conn, FileSize: 42, ModTime: when, Name: "b.txt", RelativePath: []string{"a", "c"}}},
+		{"FileWithoutModTime", File{ID: id, ConnectionID: conn, FileSize: 0, Name: "b.txt", RelativePath: []string{"."}}},
+		{"FileChunk", FileChunk{ID: id, ConnectionID: conn, Seq: 7, Data: []byte("data")}},
+		{"FileComplete", FileComplete{ID: id, ConnectionID: conn, Checksum: []byte{1, 2, 3}}},
+		{"ConnectionClose", ConnectionClose{ConnectionID: conn}},
+		{"ListRequest", ListRequest{Path: "/a"}},
+		{"Listing", Listing{Path: "/a", Entries: []ListEntry{{Name: "b", Size: 1, ModTime: when, IsDir: true}, {Name: "c", Size: 2, ModTime: when}}}},
+		{"GetRequest", GetRequest{ConnectionID: conn, Paths: []string{"a", "b/c"}}},
+		{"SessionError", SessionError{ConnectionID: conn, Message: "failed"}},
+		{"FileDelete", FileDelete{ConnectionID: conn, Path: "a/b"}},
+		{"Manifest", Manifest{
+			ConnectionID: conn,
+			Summary:      ManifestSummary{TotalBytes: 3, FileCount: 2, LargestPath: "a", LargestSize: 2},
+			Entries:      []ManifestEntry{{Path: "a", Size: 2, ModTime: when}, {Path: "b", Size: 1, ModTime: when}},
+		}},
+		{"SyncPlan", SyncPlan{ConnectionID: conn, Upload: []string{"a"}, Download: []string{"b"}, Conflicts: []string{"c"}}},
+		{"TransferSummary", TransferSummary{
+			ConnectionID: conn,
+			Files:        2,
+			Bytes:        3,
+			Elapsed:      time.Minute,
+			PeakRate:     4,
+			Failed:       []FileResult{result},
+			Skipped:      []FileResult{result, result},
+			Largest:      result,
+			Slowest:      result,
+		}},
+		{"Hello", Hello{MinVersion: 1, MaxVersion: 2, Software: "1.0.0", Capabilities: []string{CapChecksums, CapMetadata}}},
+		{"Session", Session{ConnectionID: conn, Mode: ModeSend}},
+		{"Credit", Credit{ID: id, ConnectionID: conn, Chunks: 2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			err := NewEncoder(&b).Encode(tt.msg)
+			if err != nil {
+				t.Fatalf("Encode: %v", err)
+			}
+
+			got, err := NewDecoder(&b).Decode()
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+
+			if c, ok := got.(FileChunk); ok {
+				c.buf = nil
+				got = c
+			}
+
+			if !reflect.DeepEqual(got, tt.msg) {
+				t.Errorf("got %#v, want %#v", got, tt.msg)
+			}
+
+			if b.Len() != 0 {
+				t.Errorf("%d bytes left after decoding", b.Len())
+			}
+		})
+	}
+}
+
+func TestSplitMessage(t *testing.T) {
+	m := Manifest{ConnectionID: uuid.New(), Entries: make([]ManifestEntry, 0)}
+	name := strings.Repeat("x", 200)
+	for i := 0; i < 100000; i++ {
+		m.Entries = append(m.Entries, ManifestEntry{Path: fmt.Sprintf("%s/%d", name, i), Size: int64(i), ModTime: time.Unix(int64(i)+1, 0)})
+	}
+
+	var b bytes.Buffer
+	err := NewEncoder(&b).Encode(m)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	if b.Len() <= MaxPayloadSize {
+		t.Fatalf("manifest of %d bytes is not split", b.Len())
+	}
+
+	if b.Bytes()[1] != TypeContinued {
+		t.Errorf("first frame has type %d, want %d", b.Bytes()[1], TypeContinued)
+	}
+
+	got, err := NewDecoder(&b).Decode()
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+
+	if !reflect.DeepEqual(got, m) {
+		t.Errorf("split manifest does not match after decoding")
+	}
+}
+
+func TestNegotiatedVersion(t *testing.T) {
+	var b bytes.Buffer
+	enc := NewEncoder(&b)
+	enc.SetVersion(2)
+
+	for _, msg := range []INetCopyMessage{Hello{MinVersion: 1, MaxVersion: 2}, ListRequest{Path: "/a"}} {
+		err := enc.Encode(msg)
+		if err != nil {
+			t.Fatalf("Encode: %v", err)
+		}
+	}
+
+	if v := b.Bytes()[0]; v != HelloVersion {
+		t.Errorf("hello framed with version %d, want %d", v, HelloVersion)
+	}
+
+	dec := NewDecoder(&b)
+	dec.SetVersion(2)
+	for i := 0; i < 2; i++ {
+		_, err := dec.Decode()
+		if err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	frame, err := NewEncoder(nil).Frame(SessionError{ConnectionID: uuid.New(), Message: "failed"})
+	if err != nil {
+		t.Fatalf("Frame: %v", err)
+	}
+
+	// a payload shorter than its fields but correctly framed
+	truncated := append([]byte{}, frame[:len(frame)-3]...)
+	binary.BigEndian.PutUint32(truncated[2:], uint32(len(truncated)-HeaderSize))
+
+	hello, err := NewEncoder(nil).Frame(Hello{MinVersion: 1, MaxVersion: 9})
+	if err != nil {
+		t.Fatalf("Frame: %v", err)
+	}
+
+	unknown := []byte{ProtocolVersion, 200, 0, 0, 0, 2, 1, 2}
+
+	tests := []struct {
+		name  string
+		input []byte
+		want  INetCopyMessage
+		err   string
+	}{
+		{"TruncatedPayload", truncated, nil, "invalid message of type 9"},
+		{"TruncatedStream", frame[:len(frame)-3], nil, io.ErrUnexpectedEOF.Error()},
+		{"TruncatedHeader", frame[:3], nil, io.ErrUnexpectedEOF.Error()},
+		{"UnknownVersion", append([]byte{9}, frame[1:]...), nil, "unsupported protocol version 9"},
+		{"HelloOfAnyVersion", append([]byte{9}, hello[1:]...), Hello{MinVersion: 1, MaxVersion: 9, Capabilities: []string{}}, ""},
+		{"OversizedPayload", []byte{ProtocolVersion, TypeFileChunk, 0xff, 0xff, 0xff, 0xff}, nil, "exceeds the maximum"},
+		{"UnknownType", unknown, UnknownMessage{Type: 200}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewDecoder(bytes.NewReader(tt.input)).Decode()
+			if tt.err == "" && err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("got error %v, want %q", err, tt.err)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
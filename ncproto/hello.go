@@ -0,0 +1,72 @@
+package ncproto
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Version of net-copy. It is set at build time with
+// -ldflags "-X github.com/bdoner/net-copy/ncproto.Version=1.0.0"
+var Version = "dev"
+
+// Capabilities a peer may support on top of the protocol version
+const (
+	// CapChecksums sends the sha256 sum of every file in FileComplete
+	// so the receiver can verify it before moving the file into place
+	CapChecksums = "checksums"
+	// CapMetadata sends the modification time of every file
+	CapMetadata = "metadata"
+	// CapCredits limits the chunks of a file in flight to what the receiver granted
+	CapCredits = "credits"
+)
+
+// Hello is the first message sent by both peers of a connection.
+// It carries the range of protocol versions and the capabilities a peer supports
+type Hello struct {
+	MinVersion   uint16
+	MaxVersion   uint16
+	Software     string
+	Capabilities []string
+}
+
+// NewHello describes this version of net-copy
+func NewHello() Hello {
+	return Hello{
+		MinVersion:   ProtocolVersion,
+		MaxVersion:   ProtocolVersion,
+		Software:     Version,
+		Capabilities: []string{CapChecksums, CapMetadata, CapCredits},
+	}
+}
+
+// Negotiate returns the highest protocol version and the capabilities both
+// local and remote support. It fails if they have no version in common.
+// Versions above 255 don't fit in a frame header and are never agreed on
+func Negotiate(local, remote Hello) (uint8, []string, error) {
+	version := local.MaxVersion
+	if remote.MaxVersion < version {
+		version = remote.MaxVersion
+	}
+	if math.MaxUint8 < version {
+		version = math.MaxUint8
+	}
+
+	if version < local.MinVersion || version < remote.MinVersion {
+		return 0, nil, fmt.Errorf("peer runs net-copy %s with protocol versions %d-%d but this net-copy %s only supports versions %d-%d",
+			remote.Software, remote.MinVersion, remote.MaxVersion, local.Software, local.MinVersion, local.MaxVersion)
+	}
+
+	caps := make([]string, 0, len(local.Capabilities))
+	for _, c := range local.Capabilities {
+		for _, rc := range remote.Capabilities {
+			if c == rc {
+				caps = append(caps, c)
+				break
+			}
+		}
+	}
+	sort.Strings(caps)
+
+	return uint8(version), caps, nil
+}
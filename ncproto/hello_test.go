@@ -0,0 +1,31 @@
+package ncproto
+
+import "testing"
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		name          string
+		local, remote Hello
+		version       uint8
+		err           bool
+	}{
+		{"Same", Hello{MinVersion: 1, MaxVersion: 1}, Hello{MinVersion: 1, MaxVersion: 1}, 1, false},
+		{"Highest", Hello{MinVersion: 1, MaxVersion: 3}, Hello{MinVersion: 2, MaxVersion: 4}, 3, false},
+		{"NoOverlap", Hello{MinVersion: 1, MaxVersion: 1}, Hello{MinVersion: 2, MaxVersion: 3}, 0, true},
+		{"AboveFrameVersion", Hello{MinVersion: 1, MaxVersion: 300}, Hello{MinVersion: 1, MaxVersion: 400}, 255, false},
+		{"OnlyAboveFrameVersion", Hello{MinVersion: 256, MaxVersion: 300}, Hello{MinVersion: 256, MaxVersion: 300}, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			version, _, err := Negotiate(tt.local, tt.remote)
+			if (err != nil) != tt.err {
+				t.Fatalf("Negotiate returned %v", err)
+			}
+
+			if version != tt.version {
+				t.Errorf("got version %d, want %d", version, tt.version)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package ncclient
+
+import (
+	"time"
+
+	"github.com/bdoner/net-copy/ncproto"
+)
+
+const (
+	// MinChunkSize is the smallest chunk an adaptive transfer sends
+	MinChunkSize = 16 * 1024
+	// MaxChunkSize is the largest chunk size that can be used
+	MaxChunkSize = 8 * 1024 * 1024
+	// maxInitialChunkSize caps the first chunk until a throughput is measured
+	maxInitialChunkSize = 1024 * 1024
+	// chunkTarget is how long sending a single adaptive chunk should take
+	chunkTarget = 100 * time.Millisecond
+	// sampleEvery is how many chunks of an adaptive transfer are sent per measurement
+	sampleEvery = 4
+)
+
+// chunkSizer decides how much of a file is sent per chunk. A fixed size is
+// taken from conf.ReadBufferSize. Adaptive chunks start out sized by the
+// file so tiny files go in one small chunk, then double or halve so every
+// chunk takes about chunkTarget at the throughput measured while sending.
+// The throughput is measured between the writes of sampled chunks, so the
+// time spent waiting for credits, the limiter and the connection all count
+type chunkSizer struct {
+	adaptive bool
+	size     int
+	chunks   int
+	// bytes were sent since the last sample was written at since
+	bytes int64
+	since time.Time
+}
+
+func newChunkSizer(fileSize int64, conf *ncproto.Config) *chunkSizer {
+	if !conf.AdaptiveChunks {
+		return &chunkSizer{size: int(conf.ReadBufferSize)}
+	}
+
+	size := MinChunkSize
+	for int64(size) < fileSize/16 && size < maxInitialChunkSize {
+		size *= 2
+	}
+
+	return &chunkSizer{adaptive: true, size: size, since: time.Now()}
+}
+
+// next returns the size of the next chunk
+func (s *chunkSizer) next() int {
+	return s.size
+}
+
+// sample reports whether the next chunk has to be waited for until it
+// is written. Every sampleEvery-th chunk of an adaptive transfer is
+func (s *chunkSizer) sample() bool {
+	return s.adaptive && s.chunks%sampleEvery == sampleEvery-1
+}
+
+// sent records a chunk of n bytes. Once a sampled chunk is written, the
+// bytes sent since the previous sample tell the throughput
+func (s *chunkSizer) sent(n int, sampled bool) {
+	if !s.adaptive {
+		return
+	}
+
+	s.chunks++
+	s.bytes += int64(n)
+	if !sampled {
+		return
+	}
+
+	d := time.Since(s.since)
+	if d <= 0 {
+		d = time.Nanosecond
+	}
+
+	ideal := float64(s.bytes) / d.Seconds() * chunkTarget.Seconds()
+	s.bytes, s.since = 0, time.Now()
+	switch {
+	case float64(2*s.size) <= ideal && s.size < MaxChunkSize:
+		s.size *= 2
+	case ideal < float64(s.size/2) && MinChunkSize < s.size:
+		s.size /= 2
+	}
+}
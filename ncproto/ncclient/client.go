@@ -1,107 +1,439 @@
 package ncclient
 
 import (
-	"encoding/gob"
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/bdoner/net-copy/ncproto"
 )
 
+var errClosed = errors.New("connection closed")
+
 // Client that connects to a server
 type Client struct {
 	Connection net.Conn
-	Encoder    *gob.Encoder
-	Decoder    *gob.Decoder
+	Encoder    *ncproto.Encoder
+	Decoder    *ncproto.Decoder
+	Limiter    *RateLimiter
+	// Reporter is told about every file sent. It may be nil
+	Reporter Reporter
+	// Version and Capabilities are agreed on by Handshake
+	Version      uint8
+	Capabilities []string
+	queue        *sendQueue
+	credits      *credits
+}
+
+// Reporter is told how the files sent by SendFile progress.
+// It is called from every goroutine sending a file
+type Reporter interface {
+	// FileStarted is called before a file is announced to the peer
+	FileStarted(file *ncproto.File, conf *ncproto.Config)
+	// Transferred is called with the size of every chunk sent
+	Transferred(file *ncproto.File, n int)
+	// FileDone is called once a file is sent with the bytes sent, when it started and its sha256 sum
+	FileDone(file *ncproto.File, conf *ncproto.Config, sent int64, started time.Time, sum []byte)
+	// FileFailed is called instead of FileDone when a file could not be sent
+	FileFailed(file *ncproto.File, conf *ncproto.Config, err error)
 }
 
-// Connect to a listening server
-func Connect(host string, port uint16) (*Client, error) {
-	connAddr := fmt.Sprintf("%s:%d", host, port)
-	conn, err := net.Dial("tcp", connAddr)
+type nopReporter struct{}
+
+func (nopReporter) FileStarted(*ncproto.File, *ncproto.Config)                        {}
+func (nopReporter) Transferred(*ncproto.File, int)                                    {}
+func (nopReporter) FileDone(*ncproto.File, *ncproto.Config, int64, time.Time, []byte) {}
+func (nopReporter) FileFailed(*ncproto.File, *ncproto.Config, error)                  {}
+
+// Connect to a listening server. host may be a hostname or an IPv4 or IPv6
+// address, optionally in brackets. When a hostname resolves to both IPv4 and
+// IPv6 addresses, the family given by preferIP ("4" or "6") is tried first
+func Connect(host string, port uint16, preferIP string) (*Client, error) {
+	if preferIP != "" && preferIP != "4" && preferIP != "6" {
+		return nil, fmt.Errorf("invalid IP preference %s. Use 4 or 6", preferIP)
+	}
+
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	addrs, err := net.DefaultResolver.LookupIPAddr(context.Background(), host)
 	if err != nil {
 		return nil, err
 	}
 
-	c := getClient(conn)
-	return c, nil
+	if preferIP != "" {
+		sort.SliceStable(addrs, func(i, j int) bool {
+			return isPreferred(addrs[i].IP, preferIP) && !isPreferred(addrs[j].IP, preferIP)
+		})
+	}
+
+	for _, a := range addrs {
+		var conn net.Conn
+		conn, err = net.Dial("tcp", net.JoinHostPort(a.String(), strconv.Itoa(int(port))))
+		if err == nil {
+			c := getClient(conn)
+			err = c.Handshake()
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return c, nil
+		}
+	}
+
+	return nil, err
 }
 
-// Listen returns a new Server struct with an open, listening connection
-func Listen(port uint16) (*Client, error) {
-	l, err := net.Listen("tcp4", fmt.Sprintf(":%d", port))
+func isPreferred(ip net.IP, preferIP string) bool {
+	return (ip.To4() != nil) == (preferIP == "4")
+}
+
+// Listen returns a new Server struct with an open, listening connection.
+// The listening address is passed to ready if not nil, otherwise it is printed
+func Listen(conf *ncproto.Config, ready func(*net.TCPAddr)) (*Client, error) {
+	s, err := NewServer(conf, ready)
 	if err != nil {
 		return nil, err
 		//fmt.Fprintf(os.Stderr, "netcopy/receive: could not listen on port %d\n", conf.Port)
 		//os.Exit(-1)
 	}
+	defer s.Listener.Close()
 
-	fmt.Printf("Listening on %s\n", l.Addr().String())
-	conn, err := l.Accept()
+	c, err := s.Accept()
 	if err != nil {
 		return nil, err
 	}
 
-	c := getClient(conn)
+	err = c.Handshake()
+	if err != nil {
+		c.Connection.Close()
+		return nil, err
+	}
+
 	return c, nil
 }
 
-func getClient(conn net.Conn) *Client {
-	gob.Register(ncproto.Config{})
-	gob.Register(ncproto.File{})
-	gob.Register(ncproto.FileChunk{})
-	gob.Register(ncproto.FileComplete{})
-	gob.Register(ncproto.ConnectionClose{})
+// Server accepts any number of clients on a single listening socket
+type Server struct {
+	Listener net.Listener
+	Allow    []*net.IPNet
+}
+
+// NewServer opens a listening socket on conf.Bind and conf.Port, or the first
+// free port of conf.PortRange, which only accepts clients matching conf.Allow.
+// The listening address is passed to ready if not nil, otherwise it is printed
+func NewServer(conf *ncproto.Config, ready func(*net.TCPAddr)) (*Server, error) {
+	allow, err := ParseAllowList(conf.Allow)
+	if err != nil {
+		return nil, err
+	}
+
+	first, last := conf.Port, conf.Port
+	if conf.PortRange != "" {
+		if conf.Port != 0 {
+			return nil, fmt.Errorf("a port and a port range can't be used together")
+		}
+
+		first, last, err = parsePortRange(conf.PortRange)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	bind := strings.TrimSuffix(strings.TrimPrefix(conf.Bind, "["), "]")
+	var l net.Listener
+	for port := int(first); port <= int(last); port++ {
+		// without a bind address this listens on both IPv4 and IPv6 where supported
+		l, err = net.Listen("tcp", net.JoinHostPort(bind, strconv.Itoa(port)))
+		if err == nil {
+			break
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = announce(l.Addr().(*net.TCPAddr), conf, ready)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return &Server{Listener: l, Allow: allow}, nil
+}
+
+// announce tells the user, and scripts, where the server is listening
+func announce(addr *net.TCPAddr, conf *ncproto.Config, ready func(*net.TCPAddr)) error {
+	if conf.PortFile != "" {
+		err := ioutil.WriteFile(conf.PortFile, []byte(fmt.Sprintf("%d\n", addr.Port)), 0644)
+		if err != nil {
+			return fmt.Errorf("could not write port file: %v", err)
+		}
+	}
+
+	if ready == nil {
+		fmt.Printf("Listening on %s\n", addr.String())
+		return nil
+	}
+
+	ready(addr)
+	return nil
+}
+
+// parsePortRange parses a range of ports like 40000-40100
+func parsePortRange(r string) (uint16, uint16, error) {
+	parts := strings.SplitN(r, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid port range %s. Use first-last", r)
+	}
 
+	first, err := strconv.ParseUint(strings.TrimSpace(parts[0]), 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range %s: %v", r, err)
+	}
+
+	last, err := strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range %s: %v", r, err)
+	}
+
+	if first == 0 || last < first {
+		return 0, 0, fmt.Errorf("invalid port range %s", r)
+	}
+
+	return uint16(first), uint16(last), nil
+}
+
+// Accept waits for the next allowed client to connect. Connections from
+// other addresses are closed before anything is read from them.
+// The caller must complete the Handshake before other messages are exchanged
+func (s *Server) Accept() (*Client, error) {
+	for {
+		conn, err := s.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		if !s.allowed(conn.RemoteAddr()) {
+			fmt.Fprintf(os.Stderr, "Accept: rejected connection from %s\n", conn.RemoteAddr().String())
+			conn.Close()
+			continue
+		}
+
+		c := getClient(conn)
+		return c, nil
+	}
+}
+
+func (s *Server) allowed(addr net.Addr) bool {
+	if len(s.Allow) == 0 {
+		return true
+	}
+
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	for _, n := range s.Allow {
+		if n.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParseAllowList parses CIDR rules like 10.0.0.0/8. A plain
+// address only allows that single address
+func ParseAllowList(rules []string) ([]*net.IPNet, error) {
+	allow := make([]*net.IPNet, 0, len(rules))
+	for _, r := range rules {
+		if !strings.Contains(r, "/") {
+			ip := net.ParseIP(r)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %s in allow list", r)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+
+			allow = append(allow, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule %s in allow list: %v", r, err)
+		}
+
+		allow = append(allow, n)
+	}
+
+	return allow, nil
+}
+
+func getClient(conn net.Conn) *Client {
 	c := Client{
 		Connection: conn,
-		Decoder:    gob.NewDecoder(conn),
-		Encoder:    gob.NewEncoder(conn),
+		Decoder:    ncproto.NewDecoder(bufio.NewReader(conn)),
+		Encoder:    ncproto.NewEncoder(conn),
 	}
+	c.queue = newSendQueue(c.Encoder, func() { c.Close() })
+	c.credits = newCredits()
 
 	return &c
 }
 
-// GetNextMessage gob decodes the next available message sent by the client
-func (c *Client) GetNextMessage(v interface{}) error {
-	return c.Decoder.Decode(v)
+// Handshake exchanges a Hello with the peer and agrees on the protocol
+// version and the capabilities used for the rest of the connection
+func (c *Client) Handshake() error {
+	local := ncproto.NewHello()
+	err := c.SendMessage(local)
+	if err != nil {
+		return err
+	}
+
+	var message ncproto.INetCopyMessage
+	err = c.GetNextMessage(&message)
+	if err != nil {
+		return fmt.Errorf("handshake failed: %v", err)
+	}
+
+	remote, ok := message.(ncproto.Hello)
+	if !ok {
+		return fmt.Errorf("handshake failed: expected a hello but got %T", message)
+	}
+
+	c.Version, c.Capabilities, err = ncproto.Negotiate(local, remote)
+	if err != nil {
+		return err
+	}
+
+	// every frame after the Hellos is framed with the agreed version
+	c.Encoder.SetVersion(c.Version)
+	c.Decoder.SetVersion(c.Version)
+	return nil
 }
 
-// SendMessage sends a gob encoded message
+// Has reports whether both peers support a capability
+func (c *Client) Has(capability string) bool {
+	for _, have := range c.Capabilities {
+		if have == capability {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetNextMessage decodes the next available message sent by the client.
+// Credits are handed to the files being sent and never returned, so a
+// sending peer must keep reading messages until its files are sent
+func (c *Client) GetNextMessage(v *ncproto.INetCopyMessage) error {
+	for {
+		msg, err := c.Decoder.Decode()
+		if err != nil {
+			c.credits.fail(err)
+			return err
+		}
+
+		if credit, ok := msg.(ncproto.Credit); ok {
+			c.credits.grant(credit)
+			continue
+		}
+
+		// no more credits are granted once the peer aborted
+		if se, ok := msg.(ncproto.SessionError); ok {
+			c.credits.fail(fmt.Errorf("peer aborted the session: %s", se.Message))
+		}
+
+		*v = msg
+		return nil
+	}
+}
+
+// Close closes the connection. Files waiting for credits stop right away
+func (c *Client) Close() error {
+	c.credits.fail(errClosed)
+	return c.Connection.Close()
+}
+
+// Grant allows the peer to send n more chunks of a file.
+// Nothing is sent unless both peers support credits
+func (c *Client) Grant(file *ncproto.File, n int) error {
+	if !c.Has(ncproto.CapCredits) {
+		return nil
+	}
+
+	return c.SendMessage(ncproto.Credit{ID: file.ID, ConnectionID: file.ConnectionID, Chunks: uint32(n)})
+}
+
+// SendMessage sends a message as a single frame. It is safe to call from
+// multiple goroutines and returns once the message is written
 func (c *Client) SendMessage(msg ncproto.INetCopyMessage) error {
-	return c.Encoder.Encode(&msg)
+	return c.queue.send(msg)
 }
 
-// SendFile will send an entire File to the server
-func (c *Client) SendFile(file *ncproto.File, wg *sync.WaitGroup, conf *ncproto.Config) {
+// SendFile will send an entire File to the server. It returns why the file could not be sent
+func (c *Client) SendFile(file *ncproto.File, wg *sync.WaitGroup, conf *ncproto.Config) error {
 	wg.Add(1)
 	defer wg.Done()
 
-	if !conf.Quiet {
-		fmt.Printf("%s (%s)\n", file.RelativeFilePath(conf), file.PrettySize())
+	report := c.Reporter
+	if report == nil {
+		report = nopReporter{}
 	}
 
-	fp, err := os.Open(file.FullFilePath(conf))
-	if err != nil {
+	started := time.Now()
+	report.FileStarted(file, conf)
+
+	fp, failure := os.Open(file.FullFilePath(conf))
+	if failure != nil {
 		fmt.Fprintf(os.Stderr, "error opening file %s\n", file.RelativeFilePath(conf))
 	}
 
-	c.SendMessage(file)
+	credits := c.Has(ncproto.CapCredits)
+	if credits {
+		c.credits.open(file.ID)
+		defer c.credits.close(file.ID)
+	}
 
-	readBuffer := make([]byte, conf.ReadBufferSize)
+	announced := *file
+	if !c.Has(ncproto.CapMetadata) {
+		announced.ModTime = time.Time{}
+	}
+	c.queue.sendFile(file.ID, announced, false)
+
+	// never send more than announced even if the file grows meanwhile
+	r := io.LimitReader(fp, file.FileSize)
+	chunks := newChunkSizer(file.FileSize, conf)
 	sentChunks := 0
-	//lastPercentage := 0
-	for {
-		n, err := fp.Read(readBuffer)
+	var sent int64
+	sum := sha256.New()
+	for failure == nil {
+		// every chunk gets its own buffer as it is written after SendFile moved on
+		readBuffer := make([]byte, chunks.next())
+		n, err := r.Read(readBuffer)
 		if n == 0 && err == io.EOF {
 			break
 		}
 
 		if err != nil && err != io.EOF {
 			fmt.Fprintf(os.Stderr, "SendFile: error reading file %s\n", file.RelativeFilePath(conf))
+			failure = err
 			break
 		}
 
@@ -112,18 +444,55 @@ func (c *Client) SendFile(file *ncproto.File, wg *sync.WaitGroup, conf *ncproto.
 			Seq:          sentChunks,
 		}
 
-		// bar, progress := file.GetProgress(sentChunks, 25, &conf)
-		// if lastPercentage < progress {
-		// 	fmt.Printf("\r%s", bar)
-		// 	lastPercentage = progress
-		// }
+		if credits {
+			err = c.credits.take(file.ID)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "SendFile: error sending %s: %v\n", file.RelativeFilePath(conf), err)
+				report.FileFailed(file, conf, err)
+				return err
+			}
+		}
+
+		if c.Limiter != nil {
+			c.Limiter.Wait(n)
+		}
 
 		sentChunks++
-		c.SendMessage(fchunk)
+		// a sampled chunk is waited for so the throughput can be measured
+		sample := chunks.sample()
+		err = c.queue.sendFile(file.ID, fchunk, sample)
+		chunks.sent(n, sample)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "SendFile: error sending %s: %v\n", file.RelativeFilePath(conf), err)
+			report.FileFailed(file, conf, err)
+			return err
+		}
+		report.Transferred(file, n)
+		sum.Write(readBuffer[:n])
+		sent += int64(n)
 		//enc.Encode(fchunk)
 	}
 
-	c.SendMessage(ncproto.FileComplete{ConnectionID: conf.ConnectionID, ID: file.ID})
+	complete := ncproto.FileComplete{ConnectionID: conf.ConnectionID, ID: file.ID}
+	if c.Has(ncproto.CapChecksums) {
+		complete.Checksum = sum.Sum(nil)
+	}
+	// waiting for the last message keeps SendFile from returning before the file is sent
+	err := c.queue.sendFile(file.ID, complete, true)
+	if failure == nil && err != nil {
+		fmt.Fprintf(os.Stderr, "SendFile: error sending %s: %v\n", file.RelativeFilePath(conf), err)
+		failure = err
+	}
+
+	if failure == nil && sent != file.FileSize {
+		failure = fmt.Errorf("sent %d of %d bytes", sent, file.FileSize)
+	}
+
+	if failure != nil {
+		report.FileFailed(file, conf, failure)
+		return failure
+	}
 
-	//fmt.Printf("\r%s>\n", strings.Repeat("#", 25))
+	report.FileDone(file, conf, sent, started, sum.Sum(nil))
+	return nil
 }
@@ -0,0 +1,82 @@
+package ncclient
+
+import (
+	"sync"
+
+	"github.com/google/uuid"
+
+	"github.com/bdoner/net-copy/ncproto"
+)
+
+// credits counts how many more chunks of every file being sent the
+// receiver allows. A file starts with ncproto.CreditWindow chunks and
+// gets more as the receiver grants them
+type credits struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	files map[uuid.UUID]uint32
+	err   error
+}
+
+func newCredits() *credits {
+	cr := &credits{files: make(map[uuid.UUID]uint32)}
+	cr.cond = sync.NewCond(&cr.mu)
+	return cr
+}
+
+// open starts counting the credits of a file
+func (cr *credits) open(id uuid.UUID) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	cr.files[id] = ncproto.CreditWindow
+}
+
+// close stops counting the credits of a file
+func (cr *credits) close(id uuid.UUID) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	delete(cr.files, id)
+}
+
+// take uses a credit of a file, waiting until one is granted
+func (cr *credits) take(id uuid.UUID) error {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	for cr.err == nil && cr.files[id] == 0 {
+		cr.cond.Wait()
+	}
+
+	if cr.err != nil {
+		return cr.err
+	}
+
+	cr.files[id]--
+	return nil
+}
+
+// grant adds credits to a file. Credits for files no longer sent are dropped
+func (cr *credits) grant(c ncproto.Credit) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	if _, found := cr.files[c.ID]; !found {
+		return
+	}
+
+	cr.files[c.ID] += c.Chunks
+	cr.cond.Broadcast()
+}
+
+// fail wakes every file waiting for credits once no more can be granted
+func (cr *credits) fail(err error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	if cr.err == nil {
+		cr.err = err
+	}
+	cr.cond.Broadcast()
+}
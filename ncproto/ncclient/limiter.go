@@ -0,0 +1,67 @@
+package ncclient
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket limiting the bytes per second sent by every
+// Client it is assigned to. It is safe to share between goroutines
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a limiter allowing rate bytes per second. 0 means no limit
+func NewRateLimiter(rate uint64) *RateLimiter {
+	r := &RateLimiter{last: time.Now()}
+	r.SetRate(rate)
+	return r
+}
+
+// SetRate changes the allowed bytes per second. 0 means no limit
+func (r *RateLimiter) SetRate(rate uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.rate = float64(rate)
+	if r.rate < r.tokens {
+		r.tokens = r.rate
+	}
+}
+
+// Rate returns the allowed bytes per second
+func (r *RateLimiter) Rate() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return uint64(r.rate)
+}
+
+// Wait blocks until n bytes may be sent
+func (r *RateLimiter) Wait(n int) {
+	r.mu.Lock()
+	if r.rate == 0 {
+		r.mu.Unlock()
+		return
+	}
+
+	now := time.Now()
+	// at most one second worth of bytes can be saved up
+	r.tokens += now.Sub(r.last).Seconds() * r.rate
+	if r.rate < r.tokens {
+		r.tokens = r.rate
+	}
+	r.last = now
+
+	// taking the tokens up front queues concurrent senders fairly
+	r.tokens -= float64(n)
+	wait := time.Duration(-r.tokens / r.rate * float64(time.Second))
+	r.mu.Unlock()
+
+	if 0 < wait {
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,190 @@
+package ncclient
+
+import (
+	"sync"
+
+	"github.com/google/uuid"
+
+	"github.com/bdoner/net-copy/ncproto"
+)
+
+// fileQueueSize is how many messages of a single file may wait to be written.
+// A file sending faster than the connection blocks once its queue is full
+const fileQueueSize = 4
+
+type queued struct {
+	frame []byte
+	// done receives the result of the write. It is nil if nobody waits for it
+	done chan error
+}
+
+// sendQueue serializes every message written to a connection. Messages of a
+// file are queued per file and the files take turns, one message each, so a
+// large file can't starve the others. Messages which don't belong to a file
+// are written before any queued file data.
+// The writing goroutine only runs while something is queued. A failed
+// write ends the queue and calls closed so the peer doesn't wait for more
+type sendQueue struct {
+	enc     *ncproto.Encoder
+	closed  func()
+	mu      sync.Mutex
+	space   *sync.Cond
+	running bool
+	control []queued
+	files   map[uuid.UUID][]queued
+	order   []uuid.UUID
+	err     error
+}
+
+func newSendQueue(enc *ncproto.Encoder, closed func()) *sendQueue {
+	q := &sendQueue{enc: enc, closed: closed, files: make(map[uuid.UUID][]queued)}
+	q.space = sync.NewCond(&q.mu)
+	return q
+}
+
+// send queues a message which doesn't belong to a file and waits until it is written.
+// A message too large for a frame is refused without affecting the queue
+func (q *sendQueue) send(msg ncproto.INetCopyMessage) error {
+	frame, err := q.enc.Frame(msg)
+	if err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+
+	q.mu.Lock()
+	if q.err != nil {
+		defer q.mu.Unlock()
+		return q.err
+	}
+
+	q.control = append(q.control, queued{frame: frame, done: done})
+	q.start()
+	q.mu.Unlock()
+
+	return <-done
+}
+
+// sendFile queues a message of the file id and blocks while the queue of
+// that file is full. With wait it returns once the message is written,
+// otherwise only an earlier failed write is reported
+func (q *sendQueue) sendFile(id uuid.UUID, msg ncproto.INetCopyMessage, wait bool) error {
+	frame, err := q.enc.Frame(msg)
+	if err != nil {
+		return err
+	}
+
+	var done chan error
+	if wait {
+		done = make(chan error, 1)
+	}
+
+	q.mu.Lock()
+	for q.err == nil && fileQueueSize <= len(q.files[id]) {
+		q.space.Wait()
+	}
+
+	if q.err != nil {
+		defer q.mu.Unlock()
+		return q.err
+	}
+
+	if _, found := q.files[id]; !found {
+		q.order = append(q.order, id)
+	}
+	q.files[id] = append(q.files[id], queued{frame: frame, done: done})
+	q.start()
+	q.mu.Unlock()
+
+	if done == nil {
+		return nil
+	}
+
+	return <-done
+}
+
+// start runs the writer unless it is running already. q.mu must be held
+func (q *sendQueue) start() {
+	if q.running {
+		return
+	}
+
+	q.running = true
+	go q.run()
+}
+
+func (q *sendQueue) run() {
+	for {
+		q.mu.Lock()
+		next, ok := q.take()
+		if !ok {
+			q.running = false
+			q.mu.Unlock()
+			return
+		}
+		q.mu.Unlock()
+
+		err := q.enc.WriteFrame(next.frame)
+		if next.done != nil {
+			next.done <- err
+		}
+
+		if err != nil {
+			q.fail(err)
+			return
+		}
+	}
+}
+
+// take removes the next message to write. q.mu must be held
+func (q *sendQueue) take() (queued, bool) {
+	if 0 < len(q.control) {
+		next := q.control[0]
+		q.control = q.control[1:]
+		return next, true
+	}
+
+	if len(q.order) == 0 {
+		return queued{}, false
+	}
+
+	id := q.order[0]
+	next := q.files[id][0]
+	q.order = q.order[1:]
+	if rest := q.files[id][1:]; 0 < len(rest) {
+		q.files[id] = rest
+		q.order = append(q.order, id)
+	} else {
+		delete(q.files, id)
+	}
+
+	q.space.Broadcast()
+	return next, true
+}
+
+// fail ends the queue after a failed write. Every queued message
+// and every later one gets err
+func (q *sendQueue) fail(err error) {
+	defer q.closed()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.err = err
+	for _, m := range q.control {
+		if m.done != nil {
+			m.done <- err
+		}
+	}
+	for _, id := range q.order {
+		for _, m := range q.files[id] {
+			if m.done != nil {
+				m.done <- err
+			}
+		}
+	}
+
+	q.control, q.files, q.order = nil, nil, nil
+	q.running = false
+	q.space.Broadcast()
+}
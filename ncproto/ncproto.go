@@ -5,31 +5,52 @@ import (
 	"io"
 	"math"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 )
 
-// INetCopyMessage is the interface type that is sent using
-// gob encoding from client to server
+// INetCopyMessage is any of the messages sent between peers.
+// They are encoded as frames by an Encoder, see PROTOCOL.md
 type INetCopyMessage interface{}
 
-// Config holds configuration for both sender and receiver
+// Config holds configuration for both sender and receiver.
+// It is local to each peer and never sent, see Session
 type Config struct {
 	Hostname         string
+	PreferIP         string
 	Port             uint16
+	PortRange        string
+	PortFile         string
+	ReadyEvent       bool
+	Bind             string
+	Allow            []string
 	WorkingDirectory string
 	Threads          uint16
 	ConnectionID     uuid.UUID
 	ReadBufferSize   uint32
+	AdaptiveChunks   bool
+	BWLimit          string
+	BWLimitFile      string
 	Quiet            bool
-}
-
-// Merge two Config's
-// The calling struct is the resulting struct
-func (c *Config) Merge(conf Config) {
-	c.ConnectionID = conf.ConnectionID
-	c.ReadBufferSize = conf.ReadBufferSize
+	Output           string
+	MetricsAddr      string
+	SummaryFile      string
+	Watch            bool
+	Debounce         time.Duration
+	OnConflict       string
+	Delete           bool
+	DryRun           bool
+	MaxDelete        uint16
+	MaxBytes         uint64
+	MaxFiles         uint64
+	MaxFileSize      uint64
+	MaxDepth         uint16
+	MaxOpenFiles     uint16
+	Writers          uint16
+	Preallocate      bool
 }
 
 // File describes a file to be sent/received
@@ -37,10 +58,13 @@ type File struct {
 	ID             uuid.UUID
 	ConnectionID   uuid.UUID
 	FileSize       int64
+	ModTime        time.Time
 	Name           string
 	RelativePath   []string
 	FileDescriptor io.WriteCloser
 	ChunkQueue     chan FileChunk
+	// Checksum is the sum announced by FileComplete. It is not sent with the File
+	Checksum []byte
 	//Complete       chan bool
 }
 
@@ -50,12 +74,27 @@ type FileChunk struct {
 	ConnectionID uuid.UUID
 	Data         []byte
 	Seq          int
+	// buf is the payload Data was decoded from, see Release
+	buf *[]byte
 }
 
-// FileComplete is sent when all chunks have been transfered
+// FileComplete is sent when all chunks have been transfered. Checksum is the
+// sha256 sum of the data if the checksums capability was negotiated
 type FileComplete struct {
 	ID           uuid.UUID
 	ConnectionID uuid.UUID
+	Checksum     []byte
+}
+
+// CreditWindow is how many chunks of a file may be sent before the receiver
+// grants more when the credits capability is used
+const CreditWindow = 4
+
+// Credit allows the sender to send Chunks more chunks of the file ID
+type Credit struct {
+	ID           uuid.UUID
+	ConnectionID uuid.UUID
+	Chunks       uint32
 }
 
 // FullFilePath returns the absolute path of where a file should be located on disk according to a given config
@@ -63,16 +102,123 @@ func (f *File) FullFilePath(c *Config) string {
 	return filepath.Join(c.WorkingDirectory, filepath.Join(f.RelativePath...), f.Name)
 }
 
+// Validate checks that the RelativePath and Name sent by a peer can not point
+// outside of the directory they are joined to
+func (f *File) Validate() error {
+	for _, c := range f.RelativePath {
+		// collectFiles uses "." for files found in the root of the WorkingDirectory
+		if c == "." {
+			continue
+		}
+
+		err := ValidatePathComponent(c)
+		if err != nil {
+			return err
+		}
+	}
+
+	return ValidatePathComponent(f.Name)
+}
+
+// ValidatePath checks every component of a slash separated relative path
+func ValidatePath(p string) error {
+	for _, c := range strings.Split(p, "/") {
+		err := ValidatePathComponent(c)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// windowsNames applies the naming rules of Windows in ValidatePathComponent
+var windowsNames = runtime.GOOS == "windows"
+
+// ValidatePathComponent checks that c is a single, plain file or directory name
+// which is safe to create on this platform
+func ValidatePathComponent(c string) error {
+	switch {
+	case c == "":
+		return fmt.Errorf("empty path component")
+	case strings.HasPrefix(c, "/"):
+		return fmt.Errorf("%q is an absolute path", c)
+	case c == "." || c == "..":
+		return fmt.Errorf("%q is a relative path reference", c)
+	case strings.ContainsRune(c, '/'):
+		return fmt.Errorf("%q contains a path separator", c)
+	case strings.ContainsRune(c, 0):
+		return fmt.Errorf("%q contains a NUL byte", c)
+	case strings.HasSuffix(c, TempFileSuffix):
+		return fmt.Errorf("%q is reserved for files being received", c)
+	}
+
+	if windowsNames {
+		return validateWindowsName(c)
+	}
+
+	return nil
+}
+
+// validateWindowsName checks the names that can't be created on Windows
+func validateWindowsName(c string) error {
+	switch {
+	case 1 < len(c) && c[1] == ':':
+		return fmt.Errorf("%q starts with a drive letter, which is not allowed on Windows", c)
+	case strings.ContainsRune(c, '\\'):
+		return fmt.Errorf("%q contains a path separator on Windows", c)
+	case strings.HasSuffix(c, ".") || strings.HasSuffix(c, " "):
+		return fmt.Errorf("%q ends with a dot or space, which is not allowed on Windows", c)
+	case isReservedName(c):
+		return fmt.Errorf("%q is a reserved name on Windows", c)
+	}
+
+	return nil
+}
+
+// isReservedName reports the device names of Windows
+func isReservedName(c string) bool {
+	base := strings.ToUpper(strings.SplitN(c, ".", 2)[0])
+	switch base {
+	case "CON", "PRN", "AUX", "NUL":
+		return true
+	}
+
+	return len(base) == 4 && (strings.HasPrefix(base, "COM") || strings.HasPrefix(base, "LPT")) && '1' <= base[3] && base[3] <= '9'
+}
+
+// TempFileSuffix marks files that are still being received
+const TempFileSuffix = ".net-copy-tmp"
+
+// TempFilePath returns the hidden path a file is written to while being received.
+// It is in the same directory as the final file so it can be renamed into place.
+// The name is made from the file ID only so it fits wherever the final name does
+func (f *File) TempFilePath(c *Config) string {
+	return filepath.Join(filepath.Dir(f.FullFilePath(c)), "."+f.ID.String()+TempFileSuffix)
+}
+
+// IsTempFileName reports whether name is the name of a file made by TempFilePath
+func IsTempFileName(name string) bool {
+	id := strings.TrimSuffix(strings.TrimPrefix(name, "."), TempFileSuffix)
+	if len(id) != 36 || name != "."+id+TempFileSuffix {
+		return false
+	}
+
+	_, err := uuid.Parse(id)
+	return err == nil
+}
+
 // RelativeFilePath gives the path relative to the WorkingDirectory
 func (f *File) RelativeFilePath(c *Config) string {
 	return filepath.Join(filepath.Join(f.RelativePath...), f.Name)
 }
 
 // GetProgress returns the progress of a file transfer as an ascii bar and a number from 0-100
-func (f *File) GetProgress(count, width int, conf *Config) (string, int) {
-	cm := int(math.Max(float64(count), 1))
-	csm := int(math.Max(float64(f.FileSize/int64(conf.ReadBufferSize)), 1))
-	progress := int((float64(cm) / float64(csm)) * 100.0)
+func (f *File) GetProgress(transferred int64, width int) (string, int) {
+	progress := 100
+	if 0 < f.FileSize {
+		progress = int(math.Min(float64(transferred)/float64(f.FileSize), 1.0) * 100.0)
+	}
 	prog := int((float64(progress) / 100.0) * float64(width))
 	bar := fmt.Sprintf("%s%s>", strings.Repeat("#", prog), strings.Repeat(" ", width-prog))
 	return bar, progress
@@ -83,14 +229,145 @@ type ConnectionClose struct {
 	ConnectionID uuid.UUID
 }
 
+// ListRequest asks a serving peer for the entries found at Path
+type ListRequest struct {
+	Path string
+}
+
+// ListEntry describes a single file or directory on a serving peer
+type ListEntry struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+	IsDir   bool
+}
+
+// Listing is the answer to a ListRequest
+type Listing struct {
+	Path    string
+	Entries []ListEntry
+}
+
+// GetRequest asks a serving peer to send the given files or directories.
+// Paths are slash separated and relative to the served directory
+type GetRequest struct {
+	ConnectionID uuid.UUID
+	Paths        []string
+}
+
+// FileDelete tells the receiver to remove a file or directory.
+// Path is slash separated and relative to the WorkingDirectory
+type FileDelete struct {
+	ConnectionID uuid.UUID
+	Path         string
+}
+
+// ManifestEntry describes a single file in a Manifest
+type ManifestEntry struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
+// ManifestSummary lets the receiver check up front whether a transfer can succeed
+type ManifestSummary struct {
+	TotalBytes  int64
+	FileCount   int64
+	LargestPath string
+	LargestSize int64
+}
+
+// Manifest lists every file a peer has to offer.
+// Paths are slash separated and relative to the WorkingDirectory
+type Manifest struct {
+	ConnectionID uuid.UUID
+	Summary      ManifestSummary
+	Entries      []ManifestEntry
+}
+
+// NewManifest creates a Manifest of the given files
+func NewManifest(files []File, c *Config) Manifest {
+	m := Manifest{
+		ConnectionID: c.ConnectionID,
+		Entries:      make([]ManifestEntry, 0, len(files)),
+	}
+
+	for _, f := range files {
+		p := filepath.ToSlash(f.RelativeFilePath(c))
+		m.Entries = append(m.Entries, ManifestEntry{
+			Path:    p,
+			Size:    f.FileSize,
+			ModTime: f.ModTime,
+		})
+
+		m.Summary.TotalBytes += f.FileSize
+		m.Summary.FileCount++
+		if m.Summary.LargestSize < f.FileSize || m.Summary.LargestPath == "" {
+			m.Summary.LargestPath = p
+			m.Summary.LargestSize = f.FileSize
+		}
+	}
+
+	return m
+}
+
+// Same reports whether two entries describe the same version of a file
+func (e *ManifestEntry) Same(o *ManifestEntry) bool {
+	return e.Size == o.Size && e.ModTime.Equal(o.ModTime)
+}
+
+// SyncPlan is decided by the connecting peer of a sync session and tells
+// the listening peer which files are exchanged and which are in conflict
+type SyncPlan struct {
+	ConnectionID uuid.UUID
+	Upload       []string
+	Download     []string
+	Conflicts    []string
+}
+
+// SessionError is sent to the peer when a request can not be fulfilled
+// and the session is about to be closed
+type SessionError struct {
+	ConnectionID uuid.UUID
+	Message      string
+}
+
+// FileResult describes a single file of a TransferSummary.
+// Reason is only set for failed and skipped files
+type FileResult struct {
+	Path     string
+	Size     int64
+	Duration time.Duration
+	Reason   string
+}
+
+// TransferSummary is sent by the receiver once every file is written so
+// both peers report the same numbers. PeakRate is in bytes per second
+type TransferSummary struct {
+	ConnectionID uuid.UUID
+	Files        int64
+	Bytes        int64
+	Elapsed      time.Duration
+	PeakRate     int64
+	Failed       []FileResult
+	Skipped      []FileResult
+	Largest      FileResult
+	Slowest      FileResult
+}
+
 // PrettySize returns a human readable file size
 func (f *File) PrettySize() string {
-	ffs := float64(f.FileSize)
-	if 1000000000 < f.FileSize {
+	return PrettySize(f.FileSize)
+}
+
+// PrettySize returns a human readable representation of size bytes
+func PrettySize(size int64) string {
+	ffs := float64(size)
+	if 1000000000 < size {
 		return fmt.Sprintf("%.2fGB", ffs/1000000000.0)
-	} else if 1000000 < f.FileSize {
+	} else if 1000000 < size {
 		return fmt.Sprintf("%.2fMB", ffs/1000000.0)
-	} else if 1000 < f.FileSize {
+	} else if 1000 < size {
 		return fmt.Sprintf("%.2fKB", ffs/1000.0)
 	}
 	return fmt.Sprintf("%.0fB", ffs)
@@ -0,0 +1,68 @@
+package ncproto
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestValidatePathComponent(t *testing.T) {
+	tests := []struct {
+		name    string
+		windows bool
+		valid   bool
+	}{
+		{"file.txt", false, true},
+		{"aux.c", false, true},
+		{"a:b", false, true},
+		{`a\b`, false, true},
+		{"trailing.", false, true},
+		{"aux.c", true, false},
+		{"COM1", true, false},
+		{"a:b", true, false},
+		{`a\b`, true, false},
+		{"trailing.", true, false},
+		{"file.txt", true, true},
+		{"", false, false},
+		{".", false, false},
+		{"..", false, false},
+		{"/etc", false, false},
+		{"a/b", false, false},
+		{"a\x00b", false, false},
+		{"." + "x" + TempFileSuffix, false, false},
+	}
+
+	defer func(w bool) { windowsNames = w }(windowsNames)
+
+	for _, tt := range tests {
+		windowsNames = tt.windows
+		err := ValidatePathComponent(tt.name)
+		if (err == nil) != tt.valid {
+			t.Errorf("ValidatePathComponent(%q) with windows=%v returned %v", tt.name, tt.windows, err)
+		}
+	}
+}
+
+func TestIsTempFileName(t *testing.T) {
+	f := File{ID: uuid.New(), Name: "a.txt"}
+	tests := []struct {
+		name string
+		temp bool
+	}{
+		{filepath.Base(f.TempFilePath(&Config{})), true},
+		{"a.txt", false},
+		{"a.txt" + TempFileSuffix, false},
+		{"." + TempFileSuffix, false},
+		{"." + strings.Repeat("x", 36) + TempFileSuffix, false},
+		{"." + f.ID.String() + TempFileSuffix + ".bak", false},
+		{f.ID.String() + TempFileSuffix, false},
+	}
+
+	for _, tt := range tests {
+		if IsTempFileName(tt.name) != tt.temp {
+			t.Errorf("IsTempFileName(%q) = %v, want %v", tt.name, !tt.temp, tt.temp)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package ncproto
+
+import (
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// Modes a Session can be started in
+const (
+	ModeSend = "send"
+	ModeSync = "sync"
+)
+
+// Session is sent by the connecting peer of send and sync right after the
+// handshake. It only carries what the listening peer needs to know about
+// the session, everything else stays local to each peer
+type Session struct {
+	ConnectionID uuid.UUID
+	Mode         string
+}
+
+// NewSession starts a session of the given mode for conf
+func NewSession(mode string, conf *Config) Session {
+	return Session{ConnectionID: conf.ConnectionID, Mode: mode}
+}
+
+// Validate checks the fields of a Session sent by a peer
+// which expects to be run in the given mode
+func (s *Session) Validate(mode string) error {
+	if s.ConnectionID == uuid.Nil {
+		return fmt.Errorf("session has no connection id")
+	}
+
+	if s.ConnectionID.Variant() != uuid.RFC4122 || s.ConnectionID.Version() != 4 {
+		return fmt.Errorf("connection id %s is not a random uuid", s.ConnectionID)
+	}
+
+	switch s.Mode {
+	case ModeSend, ModeSync:
+	default:
+		return fmt.Errorf("unknown session mode %q", s.Mode)
+	}
+
+	if s.Mode != mode {
+		return fmt.Errorf("peer runs %s but this peer expects %s", s.Mode, mode)
+	}
+
+	return nil
+}